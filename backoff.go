@@ -0,0 +1,103 @@
+package logmetrics
+
+import (
+	"log"
+	"math/rand"
+	"time"
+)
+
+const (
+	breakerClosed = iota
+	breakerHalfOpen
+	breakerOpen
+)
+
+// Spaces out retries against an output that keeps failing. Waits start at push_wait
+// and grow by push_backoff_factor up to push_max_wait, randomized so collectors
+// restarted together don't retry in lockstep. After push_breaker_threshold failures
+// in a row the breaker opens: writes are dropped right away without trying the output
+// until push_max_wait is over, then a single one is let through to see if it recovered.
+// Only the state changes are logged.
+type backoff struct {
+	failures int
+	state    int
+	retry_at time.Time
+	blocked  time.Duration
+	dropped  int64
+}
+
+func (b *backoff) getWait(cfg *Config) time.Duration {
+	max_wait := time.Duration(cfg.pushMaxWait) * time.Second
+
+	wait := time.Duration(cfg.pushWait) * time.Second
+	for i := 1; i < b.failures && wait < max_wait; i++ {
+		wait *= time.Duration(cfg.pushBackoffFactor)
+	}
+	if b.state == breakerOpen || wait > max_wait {
+		wait = max_wait
+	}
+
+	//Somewhere between half and all of it
+	return wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+}
+
+func (b *backoff) isClosed() bool {
+	return b.state == breakerClosed
+}
+
+// True while the breaker is open, the nb_keys about to be written are counted as dropped.
+// Once the wait is over the breaker is half open and the next write goes through.
+func (b *backoff) failFast(nb_keys int) bool {
+	if b.state != breakerOpen {
+		return false
+	}
+	if time.Now().Before(b.retry_at) {
+		b.dropped += int64(nb_keys)
+		return true
+	}
+
+	b.state = breakerHalfOpen
+	return false
+}
+
+// Blocks until it's time to try again, unless the breaker opens
+func (b *backoff) failed(cfg *Config, msg string) {
+	b.failures++
+
+	switch {
+	case b.state == breakerHalfOpen:
+		b.state = breakerOpen
+	case b.failures >= cfg.pushBreakerThreshold:
+		b.state = breakerOpen
+		log.Printf("%s", msg)
+		log.Printf("%d failures in a row, dropping writes and retrying every %ds until it recovers", b.failures, cfg.pushMaxWait)
+	default:
+		log.Printf("%s", msg)
+	}
+
+	wait := b.getWait(cfg)
+	if b.state == breakerOpen {
+		b.retry_at = time.Now().Add(wait)
+		return
+	}
+
+	time.Sleep(wait)
+	b.blocked += wait
+}
+
+func (b *backoff) succeeded() {
+	if b.failures == 0 {
+		return
+	}
+
+	if !b.isClosed() {
+		log.Printf("Recovered after %d failures", b.failures)
+	}
+	b.failures = 0
+	b.state = breakerClosed
+}
+
+// Outputs that wait on failures, their state ends up in the pusher's stats
+type backoffReporter interface {
+	getBackoffs() []*backoff
+}
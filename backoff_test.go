@@ -0,0 +1,74 @@
+package logmetrics
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoffGetWait(t *testing.T) {
+	cfg := &Config{pushWait: 1, pushMaxWait: 10, pushBackoffFactor: 2}
+
+	//Doubles after each failure until capped by push_max_wait
+	tests := []struct {
+		failures int
+		state    int
+		max      time.Duration
+	}{
+		{1, breakerClosed, 1 * time.Second},
+		{2, breakerClosed, 2 * time.Second},
+		{3, breakerClosed, 4 * time.Second},
+		{4, breakerClosed, 8 * time.Second},
+		{5, breakerClosed, 10 * time.Second},
+		{50, breakerClosed, 10 * time.Second},
+		{1, breakerOpen, 10 * time.Second},
+	}
+
+	for _, test := range tests {
+		b := backoff{failures: test.failures, state: test.state}
+
+		seen := make(map[time.Duration]bool)
+		for i := 0; i < 100; i++ {
+			wait := b.getWait(cfg)
+			if wait < test.max/2 || wait > test.max {
+				t.Fatalf("%d failures, state %d: expected a wait between %s and %s, got %s", test.failures, test.state, test.max/2, test.max, wait)
+			}
+			seen[wait] = true
+		}
+		if len(seen) < 2 {
+			t.Errorf("%d failures, state %d: expected randomized waits, always got %v", test.failures, test.state, seen)
+		}
+	}
+}
+
+func TestBackoffOpenFailsFast(t *testing.T) {
+	cfg := &Config{pushWait: 1, pushMaxWait: 10, pushBackoffFactor: 2, pushBreakerThreshold: 2}
+
+	//Reaching the threshold opens it without waiting
+	b := backoff{failures: 1}
+	start := time.Now()
+	b.failed(cfg, "down")
+	if b.state != breakerOpen || time.Now().Sub(start) > time.Second {
+		t.Fatalf("expected the breaker to open right away, state %d after %s", b.state, time.Now().Sub(start))
+	}
+
+	if !b.failFast(3) || !b.failFast(2) || b.dropped != 5 {
+		t.Fatalf("expected writes to be dropped while open, %d dropped", b.dropped)
+	}
+
+	//A single try once the wait is over
+	b.retry_at = time.Now()
+	if b.failFast(1) || b.state != breakerHalfOpen {
+		t.Fatalf("expected a retry once the wait is over, state %d", b.state)
+	}
+	b.failed(cfg, "still down")
+	if b.state != breakerOpen || !b.failFast(1) {
+		t.Fatalf("expected a failed retry to open it again, state %d", b.state)
+	}
+
+	b.retry_at = time.Now()
+	b.failFast(1)
+	b.succeeded()
+	if !b.isClosed() || b.failFast(1) {
+		t.Errorf("expected a successful retry to close it, state %d", b.state)
+	}
+}
@@ -0,0 +1,116 @@
+package logmetrics
+
+import (
+	"fmt"
+)
+
+// Named groups can be used anywhere a position is. Named groups of filename_match
+// come after the line's groups.
+func (lg *logGroup) groupPositions(m *lineMapping, re regexMatcher) map[string]int {
+	positions := make(map[string]int)
+
+	if re != nil {
+		for pos, name := range re.groupNames() {
+			if name != "" {
+				positions[name] = pos
+			}
+		}
+	}
+
+	if lg.filename_match_re != nil {
+		for i, name := range lg.filename_match_re.groupNames()[1:] {
+			if name == "" {
+				continue
+			}
+			if _, found := positions[name]; found {
+				configFail(lg.name, "filename_match", "group %s is already a group of %sre", name, m.path)
+			}
+			positions[name] = m.expected_matches + 1 + i
+		}
+	}
+
+	return positions
+}
+
+// Groups of the regexes sharing the log group's mapping are put in the order of the
+// first of them: named ones by name, unnamed ones in the order they appear.
+func (lg *logGroup) compileReOrder(shared int) {
+	names := lg.re[shared].groupNames()
+
+	lg.re_order = make([][]int, len(lg.re))
+	for i := shared + 1; i < len(lg.re); i++ {
+		re_names := lg.re[i].groupNames()
+		//Group count mismatches are reported by check
+		if lg.mappings[i] != &lg.lineMapping || len(re_names) != len(names) {
+			continue
+		}
+
+		by_name := make(map[string]int)
+		var unnamed []int
+		for pos, name := range re_names[1:] {
+			if name != "" {
+				by_name[name] = pos + 1
+			} else {
+				unnamed = append(unnamed, pos+1)
+			}
+		}
+
+		order := make([]int, len(names))
+		reordered := false
+		for pos, name := range names[1:] {
+			var found bool
+			if name != "" {
+				order[pos+1], found = by_name[name]
+			} else if len(unnamed) > 0 {
+				order[pos+1], unnamed, found = unnamed[0], unnamed[1:], true
+			}
+
+			if !found {
+				configFail(lg.name, fmt.Sprintf("re[%d]", i), "groups don't match re[%d], regexes sharing tags, date and metrics need the same named groups", shared)
+			}
+			reordered = reordered || order[pos+1] != pos+1
+		}
+
+		if reordered {
+			lg.re_order[i] = order
+		}
+	}
+}
+
+// Puts the groups matched by re[i] in the order of the regexes sharing its mapping
+func (lg *logGroup) orderMatches(i int, matches []string) []string {
+	if lg.re_order == nil || lg.re_order[i] == nil {
+		return matches
+	}
+
+	ordered := make([]string, len(matches))
+	copy(ordered, matches)
+	for pos, from := range lg.re_order[i] {
+		ordered[pos] = matches[from]
+	}
+
+	return ordered
+}
+
+// A position is a group number or a group name. Json log groups use field
+// paths, only position 0, the whole line, is allowed.
+func (m *lineMapping) position(group string, path string, val interface{}) int {
+	switch v := val.(type) {
+	case int:
+		if m.fields != nil && v != 0 {
+			configFail(group, path, "json log groups use field paths, not positions")
+		}
+		return v
+	case string:
+		if pos, found := m.group_positions[v]; found {
+			return pos
+		}
+		if m.fields != nil {
+			return m.fields.position(group, path, v)
+		}
+		configFail(group, path, "no capture group named %s", v)
+	}
+
+	configFail(group, path, "expected a position or a group name, got %s", describeType(val))
+	return 0
+}
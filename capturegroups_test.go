@@ -0,0 +1,121 @@
+package logmetrics
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Keys a line ends up as, matched like the tailer does and with the value as their stat
+func getLineKeys(t *testing.T, lg *logGroup, line string) ([]string, time.Time) {
+	dp := &datapool{lg: lg}
+
+	for i, re := range lg.re {
+		matches := re.findSubmatch(line)
+		if len(matches) != lg.mappings[i].expected_matches+1 {
+			continue
+		}
+
+		m := lg.mappings[i]
+		data_points, point_time := dp.getKeys(m, dp.applyTransforms(m, lg.orderMatches(i, matches)))
+
+		keys := make([]string, len(data_points))
+		for j, data_point := range data_points {
+			keys[j] = strings.TrimSpace(fmt.Sprintf(data_point.name, "value", point_time.Unix(), fmt.Sprint(data_point.value)))
+		}
+		sort.Strings(keys)
+
+		return keys, point_time
+	}
+
+	t.Fatalf("no regex matched %q", line)
+	return nil, time.Time{}
+}
+
+func TestAlternateRegexesShareMappingByName(t *testing.T) {
+	//Same groups in another order, everything refers to them by name
+	conf := &logGroupConfig{Format: "regex", RegexEngine: "re2", Goroutines: 1, KeyPrefix: "app", Files: []string{"/var/log/app.log"},
+		Re: []regexConfig{
+			{Re: `^(?P<date>\S+)\scall\s(?P<call>\w+)\stook\s(?P<ms>\d+)ms\sfrom\s(?P<host>\S+)$`},
+			{Re: `^(?P<host>\S+)\s(?P<date>\S+)\sspent\s(?P<ms>\d+)ms\sin\s(?P<call>\w+)$`},
+		},
+		Date: dateConfig{Position: "date", Format: "2006-01-02T15:04:05"},
+		Tags: map[string]interface{}{"call": "call", "host": "host", "dc": "east"},
+		Metrics: map[string][]*metricConfig{
+			"histogram": {{KeySuffix: "call_time", Format: "int", Multiply: 1, Divide: 1, Reference: [][]interface{}{{"ms", ""}}}},
+			"meter":     {{KeySuffix: "calls", Format: "int", Multiply: 1, Divide: 1, Reference: [][]interface{}{{0, ""}}}},
+		},
+		Transform: map[interface{}]*transformConfig{
+			"call": {Operations: [][]string{{"match_or_default", "^get", "other"}}},
+		},
+	}
+	lg := newLogGroup("app", conf)
+	if errs := lg.check(); len(errs) > 0 {
+		t.Fatal(errs)
+	}
+
+	expected_time := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	expected := map[string][]string{
+		"getUser": {
+			"app.call_time.value 1704164645 12 call=getUser dc=east host=web1",
+			"app.calls.value 1704164645 1 call=getUser dc=east host=web1",
+		},
+		"postUser": {
+			"app.call_time.value 1704164645 12 call=other dc=east host=web1",
+			"app.calls.value 1704164645 1 call=other dc=east host=web1",
+		},
+	}
+
+	for call, expected_keys := range expected {
+		for _, line := range []string{
+			"2024-01-02T03:04:05 call " + call + " took 12ms from web1",
+			"web1 2024-01-02T03:04:05 spent 12ms in " + call,
+		} {
+			keys, point_time := getLineKeys(t, lg, line)
+			if !point_time.Equal(expected_time) {
+				t.Errorf("%q: expected %s, got %s", line, expected_time, point_time)
+			}
+			if strings.Join(keys, "\n") != strings.Join(expected_keys, "\n") {
+				t.Errorf("%q: expected\n%s\ngot\n%s", line, strings.Join(expected_keys, "\n"), strings.Join(keys, "\n"))
+			}
+		}
+	}
+}
+
+func TestRegexMappingInheritsDateAndTags(t *testing.T) {
+	//The second regex only has its own metrics, date and tags are the log group's
+	//looked up by name in its own groups
+	conf := &logGroupConfig{Format: "regex", RegexEngine: "re2", Goroutines: 1, KeyPrefix: "app", Files: []string{"/var/log/app.log"},
+		Re: []regexConfig{
+			{Re: `^(?P<date>\S+)\s(?P<host>\S+)\stook\s(?P<ms>\d+)ms$`},
+			{Re: `^(?P<host>\S+)\serror\s(?P<code>\d+)\sat\s(?P<date>\S+)$`,
+				Metrics: map[string][]*metricConfig{
+					"meter": {{KeySuffix: "errors", Format: "int", Multiply: 1, Divide: 1, Reference: [][]interface{}{{0, ""}}}},
+				}},
+		},
+		Date: dateConfig{Position: "date", Format: "2006-01-02T15:04:05"},
+		Tags: map[string]interface{}{"host": "host", "dc": "east"},
+		Metrics: map[string][]*metricConfig{
+			"histogram": {{KeySuffix: "call_time", Format: "int", Multiply: 1, Divide: 1, Reference: [][]interface{}{{"ms", ""}}}},
+		},
+	}
+	lg := newLogGroup("app", conf)
+	if errs := lg.check(); len(errs) > 0 {
+		t.Fatal(errs)
+	}
+
+	for _, test := range []struct {
+		line     string
+		expected string
+	}{
+		{"2024-01-02T03:04:05 web1 took 12ms", "app.call_time.value 1704164645 12 dc=east host=web1"},
+		{"web2 error 503 at 2024-01-02T03:04:06", "app.errors.value 1704164646 1 dc=east host=web2"},
+	} {
+		keys, _ := getLineKeys(t, lg, test.line)
+		if len(keys) != 1 || keys[0] != test.expected {
+			t.Errorf("%q: expected %s, got %v", test.line, test.expected, keys)
+		}
+	}
+}
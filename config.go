@@ -1,17 +1,15 @@
 package logmetrics
 
 import (
-	"errors"
+	"crypto/tls"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"log/syslog"
+	"net"
 	"os"
+	"sort"
 	"strings"
 	"time"
-
-	"github.com/mathpl/golang-pkg-pcre/src/pkg/pcre"
-	"launchpad.net/~niemeyer/goyaml/beta"
 )
 
 type Config struct {
@@ -22,10 +20,122 @@ type Config struct {
 	pushProto      string
 	pushType       string
 	pushNumber     int
+	pushBatchSize  int
+	pushRetries    int
+	pushTimeout    int
 	stats_interval int
 	logFacility    syslog.Priority
+	stateDir       string
+	stateInterval  int
+
+	shutdownTimeout int
+
+	pushFlushSize     int
+	pushFlushInterval int
+	pushLogErrors     bool
+	pushTls           *tls.Config
+
+	pushHosts            []string
+	pushStrategy         string
+	pushFailbackInterval int
+
+	pushMaxWait          int
+	pushBackoffFactor    int
+	pushBreakerThreshold int
 
+	spoolDir        string
+	spoolMaxSizeMb  int
+	spoolDropPolicy string
+
+	graphiteTemplate string
+	influxDb         string
+	kafkaTopic       string
+	prometheusListen string
+	statsdHost       string
+	statsdPort       int
+	statsdDogTags    bool
+
+	outputs   []outputConfig
 	logGroups map[string]*logGroup
+
+	//Known key prefixes and key_prefix.key_suffix, updated when log groups are reloaded
+	keyPrefixes *metricPrefixes
+	keyBases    *metricPrefixes
+
+	//Decoded config file, with defaults filled in
+	file *fileConfig
+
+	//To tell if it changed on reload
+	raw_settings string
+}
+
+type outputConfig struct {
+	pushHost  string
+	pushPort  int
+	pushProto string
+	pushType  string
+
+	graphiteTemplate string
+	influxDb         string
+	kafkaTopic       string
+
+	pushTls *tls.Config
+
+	//Every host:port to try, in order. pushHost and pushPort when push_hosts isn't set.
+	pushHosts    []string
+	pushStrategy string
+}
+
+// Output defined by the top level push_* settings
+func (conf *Config) getDefaultOutput() outputConfig {
+	return outputConfig{pushHost: conf.pushHost, pushPort: conf.pushPort, pushProto: conf.pushProto, pushType: conf.pushType,
+		graphiteTemplate: conf.graphiteTemplate, influxDb: conf.influxDb, kafkaTopic: conf.kafkaTopic,
+		pushTls: conf.pushTls, pushHosts: conf.pushHosts, pushStrategy: conf.pushStrategy}
+}
+
+func (o *outputConfig) getTarget() string {
+	if len(o.pushHosts) > 0 {
+		return o.pushHosts[0]
+	}
+	return fmt.Sprintf("%s:%d", o.pushHost, o.pushPort)
+}
+
+func (o *outputConfig) getTargets() []string {
+	if len(o.pushHosts) > 0 {
+		return o.pushHosts
+	}
+	return []string{o.getTarget()}
+}
+
+// The kafka client does its own broker selection from push_host
+func checkPushHosts(name string, push_type string, push_hosts []string) {
+	if push_type == "kafka" && len(push_hosts) > 0 {
+		configFail("", name+".push_hosts", "not used by kafka, list the brokers in push_host")
+	}
+}
+
+// Hosts without a port get push_port
+func parsePushHosts(name string, conf []string, port int) []string {
+	hosts := make([]string, len(conf))
+	for i, host := range conf {
+		if _, _, err := net.SplitHostPort(host); err == nil {
+			hosts[i] = host
+		} else if port != 0 {
+			hosts[i] = fmt.Sprintf("%s:%d", host, port)
+		} else {
+			configFail("", fmt.Sprintf("%s[%d]", name, i), "no port for %s and no push_port set", host)
+		}
+	}
+
+	return hosts
+}
+
+func checkPushStrategy(name string, strategy string) {
+	switch strategy {
+	case "failover", "round_robin", "hash":
+	default:
+		configFail("", name, "unknown strategy %s, expected failover, round_robin or hash", strategy)
+	}
 }
 
 //type match struct {
@@ -51,23 +161,46 @@ type keyExtract struct {
 	operations map[string][]int
 }
 
+// How the groups of a line become keys. Regexes share the log group's one unless
+// they have their own.
+type lineMapping struct {
+	//Prefix of its keys in the config, "" for the log group's
+	path string
+
+	expected_matches int
+	//Position of every named group
+	group_positions map[string]int
+
+	date_position int
+	date_format   string
+
+	tags      map[string]interface{}
+	tag_order []string
+	metrics   map[int][]keyExtract
+	transform map[int]transform
+
+	//Fields used by json log groups, nil for regexes
+	fields *jsonFields
+}
+
 type logGroup struct {
 	name              string
 	globFiles         []string
 	filename_match    string
-	filename_match_re *pcre.Regexp
-	re                []*pcre.Regexp
+	filename_match_re regexMatcher
+	re                []regexMatcher
+	regex_engine      string
 	strRegexp         []string
-	expected_matches  int
 	hostname          string
 
-	date_position int
-	date_format   string
+	//The log group's mapping, mappings[i] is the one used for re[i]
+	lineMapping
+	mappings []*lineMapping
+
+	//re_order[i] puts the groups of re[i] in the order of the first regex sharing its mapping
+	re_order [][]int
 
 	key_prefix string
-	tags       map[string]interface{}
-	metrics    map[int][]keyExtract
-	transform  map[int]transform
 
 	histogram_size                  int
 	histogram_alpha_decay           float64
@@ -87,23 +220,41 @@ type logGroup struct {
 	out_of_order_time_warn bool
 	log_stale_metrics      bool
 	parse_from_start       bool
+	statsd_passthrough     bool
+
+	//To tell if it changed on reload
+	raw_config string
 
 	//Channels
 	tail_data []chan lineResult
 }
 
-func (lg *logGroup) getNbTags() int {
-	return len(lg.tags)
+func (m *lineMapping) getNbTags() int {
+	return len(m.tags)
 }
 
-func (lg *logGroup) getNbKeys() int {
+func (m *lineMapping) getNbKeys() int {
 	i := 0
-	for _, metrics := range lg.metrics {
+	for _, metrics := range m.metrics {
 		i += len(metrics)
 	}
 	return i
 }
 
+// Every mapping used by a regex, in the order of the regexes
+func (lg *logGroup) usedMappings() []*lineMapping {
+	var used []*lineMapping
+	seen := make(map[*lineMapping]bool)
+	for _, m := range lg.mappings {
+		if !seen[m] {
+			seen[m] = true
+			used = append(used, m)
+		}
+	}
+
+	return used
+}
+
 func (conf *Config) GetPusherNumber() int {
 	return conf.pushNumber
 }
@@ -112,13 +263,18 @@ func (conf *Config) GetTsdTarget() string {
 	return fmt.Sprintf("%s:%d", conf.pushHost, conf.pushPort)
 }
 
+func (conf *Config) GetShutdownTimeout() time.Duration {
+	return time.Duration(conf.shutdownTimeout) * time.Second
+}
+
 func (conf *Config) GetSyslogFacility() syslog.Priority {
 	return conf.logFacility
 }
 
-func (lg *logGroup) CreateDataPool(channel_number int, tsd_pushers []chan []string, tsd_channel_number int) *datapool {
+func (lg *logGroup) CreateDataPool(channel_number int, tsd_pushers []chan []string, tsd_channel_number int, state_dir string, state_interval int) *datapool {
 	var dp datapool
 	dp.Bye = make(chan bool)
+	dp.done = make(chan bool)
 	dp.duplicateSent = make(map[string]time.Time)
 
 	dp.channel_number = channel_number
@@ -133,7 +289,17 @@ func (lg *logGroup) CreateDataPool(channel_number int, tsd_pushers []chan []stri
 
 	dp.lg = lg
 
-	dp.compileTagOrder()
+	//Pick up where the previous run left off
+	if state_dir != "" {
+		dp.state_file = getDatapoolStateFilename(state_dir, lg.name, channel_number)
+		dp.state_interval = state_interval
+
+		if err := dp.loadState(); err != nil {
+			log.Printf("Datapool[%s:%d] unable to load state from %s, starting fresh: %s", lg.name, channel_number, dp.state_file, err)
+		} else if len(dp.data) > 0 {
+			log.Printf("Datapool[%s:%d] restored %d metrics from %s", lg.name, channel_number, len(dp.data), dp.state_file)
+		}
+	}
 
 	return &dp
 }
@@ -142,13 +308,13 @@ func getHostname() string {
 	//Get hostname
 	hostname, err := os.Hostname()
 	if err != nil {
-		log.Fatalf("Unable to get hostname: ", err)
+		log.Fatalf("Unable to get hostname: %s", err)
 	}
 
 	return hostname
 }
 
-func cleanSre2(log_group_name string, re string) (string, *pcre.Regexp, error) {
+func cleanSre2(engine string, re string) (string, regexMatcher, error) {
 	//Little hack to support extended style regex. Removes comments, spaces en endline
 	noSpacesRe := strings.Replace(re, " ", "", -1)
 	splitRe := strings.Split(noSpacesRe, "\\n")
@@ -161,76 +327,75 @@ func cleanSre2(log_group_name string, re string) (string, *pcre.Regexp, error) {
 	cleanRe := strings.Join(rebuiltRe, "")
 
 	//Try to compile the regex
-	if compiledRe, err := pcre.Compile(cleanRe, 0); err == nil {
-		return cleanRe, &compiledRe, nil
+	if compiledRe, err := compileRegex(engine, cleanRe); err == nil {
+		return cleanRe, compiledRe, nil
 	} else {
-		return "", nil, errors.New(err.Message)
+		return "", nil, err
 	}
 }
 
-func parseMetrics(conf map[interface{}]interface{}) map[int][]keyExtract {
+func parseMetrics(group string, mapping *lineMapping, conf map[string][]*metricConfig) map[int][]keyExtract {
 	keyExtracts := make(map[int][]keyExtract)
 
 	for metric_type, metrics := range conf {
-		for _, n := range metrics.([]interface{}) {
-			m := n.(map[interface{}]interface{})
-
-			key_suffix := m["key_suffix"].(string)
+		switch metric_type {
+		case "meter", "counter", "histogram":
+		default:
+			configFail(group, mapping.path+"metrics."+metric_type, "unknown metric type, expected meter, counter or histogram")
+		}
 
-			var format string
-			var multiply int
-			var divide int
-			var never_stale bool
+		for i, m := range metrics {
+			path := fmt.Sprintf("%smetrics.%s[%d]", mapping.path, metric_type, i)
+			if m == nil {
+				configFail(group, path, "empty metric")
+			}
 
-			if format_key, ok := m["format"]; ok == true {
-				format = format_key.(string)
-			} else {
-				format = "int"
+			if m.KeySuffix == "" {
+				configFail(group, path+".key_suffix", "missing")
 			}
-			if multiply_key, ok := m["multiply"]; ok == true {
-				multiply = multiply_key.(int)
-				if multiply == 0 {
-					log.Fatalf("A 'multiply' transform cannot be zero")
-				}
-			} else {
-				multiply = 1
+			if m.Format != "int" && m.Format != "float" {
+				configFail(group, path+".format", "unknown format %s, expected int or float", m.Format)
 			}
-			if divide_key, ok := m["divide"]; ok == true {
-				divide = divide_key.(int)
-				if divide < 1 {
-					log.Fatalf("A 'divide' transform cannot be zero")
-				}
-			} else {
-				divide = 1
+			if m.Multiply == 0 {
+				configFail(group, path+".multiply", "cannot be zero")
 			}
-			if never_stale_key, ok := m["never_stale"]; ok == true {
-				never_stale = never_stale_key.(bool)
-			} else {
-				never_stale = false
+			if m.Divide < 1 {
+				configFail(group, path+".divide", "must be at least 1")
+			}
+			if len(m.Reference) == 0 {
+				configFail(group, path+".reference", "missing, at least one reference is required")
 			}
 
-			for _, val := range m["reference"].([]interface{}) {
-				position := val.([]interface{})[0].(int)
-				tag := val.([]interface{})[1].(string)
+			for j, reference := range m.Reference {
+				ref_path := fmt.Sprintf("%s.reference[%d]", path, j)
+				if len(reference) < 2 || len(reference) > 3 {
+					configFail(group, ref_path, "expected [position, tag] or [position, tag, operations], got %d items", len(reference))
+				}
+
+				position := mapping.position(group, ref_path+"[0]", reference[0])
+				tag := toString(group, ref_path+"[1]", reference[1])
 
 				operations := make(map[string][]int)
-				if len(val.([]interface{})) > 2 {
-					operations_struct := val.([]interface{})[2].(map[interface{}]interface{})
+				if len(reference) > 2 {
+					operations_struct := toMap(group, ref_path+"[2]", reference[2])
+
+					for rawOp, opvals := range operations_struct {
+						op := toString(group, ref_path+"[2]", rawOp)
+						op_path := ref_path + "[2]." + op
 
-					for op, opvals := range operations_struct {
 						//Make sure we only accept operation we can perform
 						if op != "add" && op != "sub" {
-							log.Fatalf("Operation %s no supported", op)
+							configFail(group, op_path, "unknown operation, expected add or sub")
 						}
 
-						for _, opval := range opvals.([]interface{}) {
-							operations[op.(string)] = append(operations[op.(string)], opval.(int))
+						for k, opval := range toList(group, op_path, opvals) {
+							operations[op] = append(operations[op], mapping.position(group, fmt.Sprintf("%s[%d]", op_path, k), opval))
 						}
 					}
 				}
 
-				newKey := keyExtract{tag: tag, metric_type: metric_type.(string), key_suffix: key_suffix,
-					format: format, multiply: multiply, divide: divide, never_stale: never_stale, operations: operations}
+				newKey := keyExtract{tag: tag, metric_type: metric_type, key_suffix: m.KeySuffix,
+					format: m.Format, multiply: m.Multiply, divide: m.Divide, never_stale: m.NeverStale, operations: operations}
 				keyExtracts[position] = append(keyExtracts[position], newKey)
 			}
 		}
@@ -239,266 +404,301 @@ func parseMetrics(conf map[interface{}]interface{}) map[int][]keyExtract {
 	return keyExtracts
 }
 
+func parseOutputs(cfg *Config, settings *settingsConfig) []outputConfig {
+	outputs := make([]outputConfig, len(settings.Outputs))
+
+	for i, o := range settings.Outputs {
+		name := fmt.Sprintf("settings.outputs[%d]", i)
+		if o == nil {
+			configFail("", name, "empty output")
+		}
+
+		own_hosts := o.PushHosts
+		own_tls := o.PushTls
+		o.setDefaults(settings)
+
+		if own_hosts != nil {
+			o.PushHosts = parsePushHosts(name+".push_hosts", own_hosts, o.PushPort)
+		} else if o.PushPort == 0 {
+			configFail("", name+".push_port", "missing, required without push_hosts")
+		}
+		checkPushStrategy(name+".push_strategy", o.PushStrategy)
+		checkPushHosts(name, o.PushType, o.PushHosts)
+
+		output := outputConfig{pushHost: o.PushHost, pushPort: o.PushPort, pushProto: o.PushProto, pushType: o.PushType,
+			graphiteTemplate: o.GraphiteTemplate, influxDb: o.InfluxDb, kafkaTopic: o.KafkaTopic,
+			pushTls: cfg.pushTls, pushHosts: o.PushHosts, pushStrategy: o.PushStrategy}
+		if own_tls != nil {
+			output.pushTls = parseTlsConfig(name+".push_tls", own_tls)
+		}
+
+		outputs[i] = output
+	}
+
+	return outputs
+}
+
+// Errors in the config file stop the program at startup
 func LoadConfig(configFile string) Config {
-	byteConfig, err := ioutil.ReadFile(configFile)
+	cfg, err := ParseConfig(configFile)
 	if err != nil {
-		log.Print(err)
-		os.Exit(1)
+		log.Fatal(err)
 	}
 
-	var rawCfg interface{}
-	err = goyaml.Unmarshal(byteConfig, &rawCfg)
-	if err != nil {
-		log.Print(err)
-		os.Exit(1)
+	return cfg
+}
+
+// Loads and checks a config file. The error is a *ConfigError or ConfigErrors when
+// something's wrong with the file itself.
+func ParseConfig(configFile string) (cfg Config, err error) {
+	defer recoverConfigError(configFile, &err)
+
+	cfg = loadConfig(configFile)
+	if errs := cfg.check(); len(errs) > 0 {
+		return cfg, errs
 	}
 
-	settings := rawCfg.(map[interface{}]interface{})["settings"]
+	return cfg, nil
+}
+
+func loadConfig(configFile string) Config {
+	fc := readConfigFile(configFile)
+	s := &fc.Settings
 
 	var cfg Config
+	cfg.file = fc
 	cfg.logGroups = make(map[string]*logGroup)
 
 	//Settings
-	for key, val := range settings.(map[interface{}]interface{}) {
-		switch v := val.(type) {
-		case int:
-			switch key {
-			case "poll_interval":
-				cfg.pollInterval = v
-			case "push_port":
-				cfg.pushPort = v
-			case "push_wait":
-				cfg.pushWait = v
-			case "push_number":
-				cfg.pushNumber = v
-			case "stats_interval":
-				cfg.stats_interval = v
-
-			default:
-				log.Fatalf("Unknown key settings.%s", key)
-			}
-
-		case string:
-			switch key {
-			case "log_facility":
-				//Lookup
-				if facility, found := facilityStrings[v]; found == true {
-					cfg.logFacility = syslog.LOG_INFO | facility
-				} else {
-					log.Fatalf("Unable to map log_facility: %s", v)
-				}
-			case "push_host":
-				cfg.pushHost = v
-			case "push_proto":
-				cfg.pushProto = v
-			case "push_type":
-				cfg.pushType = v
-
-			default:
-				log.Fatalf("Unknown key settings.%s", key)
-			}
-
-		default:
-			log.Fatalf("Unknown key settings.%s", key)
-		}
-	}
-
-	//Some default vals
-	if cfg.pollInterval == 0 {
-		cfg.pollInterval = 15
-	}
-	if cfg.logFacility == 0 {
-		cfg.logFacility = syslog.LOG_LOCAL0
-	}
-	if cfg.pushHost == "" {
-		cfg.pushHost = "localhost"
-	}
-	if cfg.pushProto == "" {
-		cfg.pushProto = "udp"
-	}
-	if cfg.pushType == "" {
-		cfg.pushType = "tcollector"
-	}
-	if cfg.pushNumber == 0 {
-		cfg.pushNumber = 1
+	if facility, found := facilityStrings[s.LogFacility]; found == true {
+		cfg.logFacility = syslog.LOG_INFO | facility
+	} else {
+		configFail("", "settings.log_facility", "unknown facility %s", s.LogFacility)
 	}
-	if cfg.stats_interval == 0 {
-		cfg.stats_interval = 60
+	switch s.SpoolDropPolicy {
+	case "block", "drop_oldest", "drop_newest":
+	default:
+		configFail("", "settings.spool_drop_policy", "unknown policy %s, expected block, drop_oldest or drop_newest", s.SpoolDropPolicy)
 	}
+	checkPushStrategy("settings.push_strategy", s.PushStrategy)
 
-	//Log_groups configs
-	for name, group_content := range rawCfg.(map[interface{}]interface{}) {
-		//Skip settings, already parsed
-		if name == "settings" {
-			continue
+	if s.PushHosts != nil {
+		s.PushHosts = parsePushHosts("settings.push_hosts", s.PushHosts, s.PushPort)
+		if s.Outputs == nil {
+			checkPushHosts("settings", s.PushType, s.PushHosts)
 		}
+	}
+	if s.PushTls != nil {
+		cfg.pushTls = parseTlsConfig("settings.push_tls", s.PushTls)
+	}
 
-		var lg logGroup
-
-		lg.name = name.(string)
-		lg.tags = make(map[string]interface{})
-
-		//Process content
-		for key, val := range group_content.(map[interface{}]interface{}) {
-			switch v := val.(type) {
-			case string:
-				switch key {
-				case "key_prefix":
-					lg.key_prefix = v
+	cfg.pollInterval = s.PollInterval
+	cfg.stats_interval = s.StatsInterval
+	cfg.stateDir = s.StateDir
+	cfg.stateInterval = s.StateInterval
+	cfg.shutdownTimeout = s.ShutdownTimeout
+
+	cfg.pushHost = s.PushHost
+	cfg.pushPort = s.PushPort
+	cfg.pushHosts = s.PushHosts
+	cfg.pushProto = s.PushProto
+	cfg.pushType = s.PushType
+	cfg.pushStrategy = s.PushStrategy
+	cfg.graphiteTemplate = s.GraphiteTemplate
+	cfg.influxDb = s.InfluxDb
+	cfg.kafkaTopic = s.KafkaTopic
+
+	cfg.pushNumber = s.PushNumber
+	cfg.pushWait = s.PushWait
+	cfg.pushBatchSize = s.PushBatchSize
+	cfg.pushRetries = s.PushRetries
+	cfg.pushTimeout = s.PushTimeout
+	cfg.pushFlushSize = s.PushFlushSize
+	cfg.pushFlushInterval = s.PushFlushIntervalMs
+	cfg.pushLogErrors = s.PushLogErrors
+	cfg.pushFailbackInterval = s.PushFailbackInterval
+	cfg.pushMaxWait = s.PushMaxWait
+	cfg.pushBackoffFactor = s.PushBackoffFactor
+	cfg.pushBreakerThreshold = s.PushBreakerThreshold
+
+	cfg.prometheusListen = s.PrometheusListen
+	cfg.statsdHost = s.StatsdHost
+	cfg.statsdPort = s.StatsdPort
+	cfg.statsdDogTags = s.StatsdDogstatsd
+
+	cfg.spoolDir = s.SpoolDir
+	cfg.spoolMaxSizeMb = s.SpoolMaxSizeMb
+	cfg.spoolDropPolicy = s.SpoolDropPolicy
+
+	//Outputs, the top level push_* settings are used as defaults for each of them
+	if s.Outputs != nil {
+		cfg.outputs = parseOutputs(&cfg, s)
+	} else if cfg.pushPort != 0 || len(cfg.pushHosts) > 0 {
+		cfg.outputs = []outputConfig{cfg.getDefaultOutput()}
+	}
 
-				case "filename_match":
-					lg.filename_match = v
-					re := pcre.MustCompile(v, 0)
-					lg.filename_match_re = &re
+	cfg.raw_settings = marshalConfig(s)
 
-				default:
-					log.Fatalf("Unknown key %s.%s", name, key)
-				}
+	//Log_groups configs
+	for name, group := range fc.LogGroups {
+		cfg.logGroups[name] = newLogGroup(name, group)
+	}
+	cfg.keyPrefixes = newMetricPrefixes(getKeyPrefixes(cfg.logGroups))
+	cfg.keyBases = newMetricPrefixes(getKeyBases(cfg.logGroups))
 
-			case int:
-				switch key {
-				case "interval":
-					lg.interval = v
-				case "ewma_interval":
-					lg.ewma_interval = v
-				case "expected_matches":
-					lg.expected_matches = v
-				case "histogram_size":
-					lg.histogram_size = v
-				case "goroutines":
-					lg.goroutines = v
-				case "histogram_rescale_threshold_min":
-					lg.histogram_rescale_threshold_min = v
-				case "stale_treshold_min":
-					lg.stale_treshold_min = v
-
-				default:
-					log.Fatalf("Unknown key %s.%s", name, key)
-				}
+	return cfg
+}
 
-			case float64:
-				switch key {
-				case "histogram_alpha_decay":
-					lg.histogram_alpha_decay = v
+func newLogGroup(name string, conf *logGroupConfig) *logGroup {
+	lg := logGroup{name: name, globFiles: conf.Files, filename_match: conf.FilenameMatch,
+		key_prefix: conf.KeyPrefix, regex_engine: conf.RegexEngine,
+		histogram_size: conf.HistogramSize, histogram_alpha_decay: conf.HistogramAlphaDecay,
+		histogram_rescale_threshold_min: conf.HistogramRescaleThresholdMin, ewma_interval: conf.EwmaInterval,
+		stale_removal: conf.StaleRemoval, stale_treshold_min: conf.StaleTresholdMin, send_duplicates: conf.SendDuplicates,
+		goroutines: conf.Goroutines, interval: conf.Interval, poll_file: conf.PollFile, live_poll: conf.LivePoll,
+		fail_operation_warn: conf.WarnOnOperationFail, fail_regex_warn: conf.WarnOnRegexFail,
+		out_of_order_time_warn: conf.WarnOnOutOfOrderTime, log_stale_metrics: conf.LogStaleMetrics,
+		parse_from_start: conf.ParseFromStart, statsd_passthrough: conf.StatsdPassthrough}
+
+	if err := checkRegexEngine(conf.RegexEngine); err != nil {
+		configFail(name, "regex_engine", "%s", err)
+	}
 
-				default:
-					log.Fatalf("Unknown key %s.%s", name, key)
-				}
+	var err error
+	if conf.FilenameMatch != "" {
+		if lg.filename_match_re, err = compileRegex(conf.RegexEngine, conf.FilenameMatch); err != nil {
+			configFail(name, "filename_match", "invalid regex: %s", err)
+		}
+	}
 
-			case bool:
-				switch key {
-				case "warn_on_regex_fail":
-					lg.fail_regex_warn = v
-				case "parse_from_start":
-					lg.parse_from_start = v
-				case "warn_on_operation_fail":
-					lg.fail_operation_warn = v
-				case "warn_on_out_of_order_time":
-					lg.out_of_order_time_warn = v
-				case "poll_file":
-					lg.poll_file = v
-				case "live_poll":
-					lg.live_poll = v
-				case "stale_removal":
-					lg.stale_removal = v
-				case "send_duplicates":
-					lg.send_duplicates = v
-				case "log_stale_metrics":
-					lg.log_stale_metrics = v
-
-				default:
-					log.Fatalf("Unknown key %s.%s", name, key)
-				}
+	switch conf.Format {
+	case "regex":
+		lg.parseReMapping(conf)
+	case "json":
+		if len(conf.Re) > 0 {
+			configFail(name, "re", "not used by json log groups, fields are given by path")
+		}
+		if conf.ExpectedMatches != 0 {
+			configFail(name, "expected_matches", "not used by json log groups")
+		}
+		lg.parseJsonMapping(conf)
+	default:
+		configFail(name, "format", "unknown format %s, expected regex or json", conf.Format)
+	}
 
-			case []interface{}:
-				switch key {
-				case "re":
-					var err error
-					lg.re = make([]*pcre.Regexp, len(v))
-					lg.strRegexp = make([]string, len(v))
-					for i, re := range v {
-						if lg.strRegexp[i], lg.re[i], err = cleanSre2(lg.name, re.(string)); err != nil {
-							log.Fatal(err)
-						}
-					}
-				case "files":
-					for _, file := range v {
-						lg.globFiles = append(lg.globFiles, file.(string))
-					}
+	if conf.Transform != nil {
+		parseTransform(&lg, conf.Transform)
+	}
 
-				default:
-					log.Fatalf("Unknown key %s.%s", name, key)
-				}
+	lg.raw_config = marshalConfig(conf)
 
-			case map[interface{}]interface{}:
-				switch key {
-				case "tags":
-					for tag, pos := range v {
-						switch pos.(type) {
-						case int:
-							lg.tags[tag.(string)] = pos.(int)
-						case string:
-							lg.tags[tag.(string)] = pos.(string)
-						default:
-							log.Fatalf("Unexpected type for tags section, key %s: %T", tag, pos)
-						}
-					}
+	//Init channels
+	lg.tail_data = make([]chan lineResult, lg.goroutines)
+	for i := 0; i < lg.goroutines; i++ {
+		lg.tail_data[i] = make(chan lineResult, 1000)
+	}
+	lg.hostname = getHostname()
 
-				case "metrics":
-					lg.metrics = parseMetrics(v)
-
-				case "date":
-					for date_name, date_val := range v {
-						if date_name.(string) == "position" {
-							lg.date_position = date_val.(int)
-						} else if date_name.(string) == "format" {
-							lg.date_format = date_val.(string)
-						} else {
-							log.Fatalf("Unknown key %s.date.%s", name, date_name)
-						}
-					}
+	return &lg
+}
 
-				case "transform":
-					lg.transform = parseTransform(v)
+// Regexes of a log group and their tags, date and metrics
+func (lg *logGroup) parseReMapping(conf *logGroupConfig) {
+	var err error
 
-				default:
-					log.Fatalf("Unknown key %s.%s", name, key)
-				}
+	lg.re = make([]regexMatcher, len(conf.Re))
+	lg.strRegexp = make([]string, len(conf.Re))
+	for i, re := range conf.Re {
+		if lg.strRegexp[i], lg.re[i], err = cleanSre2(conf.RegexEngine, re.Re); err != nil {
+			configFail(lg.name, fmt.Sprintf("re[%d]", i), "invalid regex: %s", err)
+		}
+	}
 
-			default:
-				log.Fatalf("Unknown key %s.%s", name, key)
+	//Regexes without tags, date or metrics of their own share the log group's.
+	//The first of them sets the layout of the others.
+	lg.mappings = make([]*lineMapping, len(conf.Re))
+	shared := -1
+	for i := range conf.Re {
+		if !conf.Re[i].hasMapping() {
+			lg.mappings[i] = &lg.lineMapping
+			if shared < 0 {
+				shared = i
 			}
 		}
+	}
 
-		//Defaults
-		if lg.goroutines == 0 {
-			lg.goroutines = 1
+	if shared >= 0 {
+		//Defaults to what the regex captures
+		if conf.ExpectedMatches == 0 {
+			conf.ExpectedMatches = lg.re[shared].groups()
 		}
-		if lg.histogram_alpha_decay == 0 {
-			lg.histogram_alpha_decay = 0.15
+
+		lg.parseMapping(&lg.lineMapping, lg.re[shared], conf.ExpectedMatches, conf.Tags, &conf.Date, conf.Metrics)
+		lg.compileReOrder(shared)
+	} else {
+		lg.expected_matches = conf.ExpectedMatches
+	}
+
+	//The others get theirs, with what they leave out taken from the log group
+	for i := range conf.Re {
+		re := &conf.Re[i]
+		if !re.hasMapping() {
+			continue
 		}
-		if lg.histogram_size == 0 {
-			lg.histogram_size = 256
+
+		if re.ExpectedMatches == 0 {
+			re.ExpectedMatches = lg.re[i].groups()
 		}
-		if lg.histogram_rescale_threshold_min == 0 {
-			lg.histogram_rescale_threshold_min = 60
+		tags, date, metrics := re.Tags, re.Date, re.Metrics
+		if tags == nil {
+			tags = conf.Tags
 		}
-		if lg.ewma_interval == 0 {
-			lg.ewma_interval = 30
+		if date == nil {
+			date = &conf.Date
 		}
-		if lg.stale_treshold_min == 0 {
-			lg.stale_treshold_min = 60
+		if metrics == nil {
+			metrics = conf.Metrics
 		}
 
-		//Init channels
-		lg.tail_data = make([]chan lineResult, lg.goroutines)
-		for i := 0; i < lg.goroutines; i++ {
-			lg.tail_data[i] = make(chan lineResult, 1000)
+		m := lineMapping{path: fmt.Sprintf("re[%d].", i)}
+		lg.parseMapping(&m, lg.re[i], re.ExpectedMatches, tags, date, metrics)
+		lg.mappings[i] = &m
+	}
+}
+
+// Tags, date and metrics of a regex, re is nil for json log groups
+func (lg *logGroup) parseMapping(m *lineMapping, re regexMatcher, expected_matches int, tags map[string]interface{}, date *dateConfig, metrics map[string][]*metricConfig) {
+	m.expected_matches = expected_matches
+	m.group_positions = lg.groupPositions(m, re)
+
+	m.date_format = date.Format
+	if date.Position != nil {
+		m.date_position = m.position(lg.name, m.path+"date.position", date.Position)
+	}
+
+	//Strings naming a group are that group, other strings are used as is.
+	//For json log groups fields are prefixed by $, ie: $request.path.
+	m.tags = make(map[string]interface{})
+	m.tag_order = nil
+	for tag, pos := range tags {
+		switch p := pos.(type) {
+		case int:
+			m.tags[tag] = m.position(lg.name, m.path+"tags."+tag, p)
+		case string:
+			if group_pos, found := m.group_positions[p]; found {
+				m.tags[tag] = group_pos
+			} else if m.fields != nil && strings.HasPrefix(p, "$") {
+				m.tags[tag] = m.position(lg.name, m.path+"tags."+tag, p)
+			} else {
+				m.tags[tag] = p
+			}
+		default:
+			configFail(lg.name, m.path+"tags."+tag, "expected a position or a string, got %s", describeType(pos))
 		}
-		lg.hostname = getHostname()
 
-		cfg.logGroups[name.(string)] = &lg
+		m.tag_order = append(m.tag_order, tag)
 	}
+	sort.Strings(m.tag_order)
 
-	return cfg
+	m.metrics = parseMetrics(lg.name, m, metrics)
 }
@@ -0,0 +1,113 @@
+package logmetrics
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Checks what parsing alone can't: positions have to exist in what the regexes capture.
+// Lines have expected_matches groups followed by the filename_match groups, position 0
+// being the whole line. Metric values and operations only use the line's groups.
+// Regexes with their own tags, date and metrics are checked against their own groups.
+// Json log groups have the fields they use as groups.
+func (lg *logGroup) check() ConfigErrors {
+	var errs ConfigErrors
+	fail := func(path string, format string, v ...interface{}) {
+		errs = append(errs, newConfigError(lg.name, path, format, v...))
+	}
+
+	if lg.key_prefix == "" {
+		fail("key_prefix", "missing")
+	}
+	if len(lg.globFiles) == 0 {
+		fail("files", "missing, at least one file glob is required")
+	}
+	if len(lg.re) == 0 && lg.fields == nil {
+		fail("re", "missing, at least one regex is required")
+	}
+
+	for i, re := range lg.re {
+		if groups, expected := re.groups(), lg.mappings[i].expected_matches; groups != expected {
+			fail(fmt.Sprintf("re[%d]", i), "has %d capture groups but expected_matches is %d", groups, expected)
+		}
+	}
+
+	filename_groups := 0
+	if lg.filename_match_re != nil {
+		filename_groups = lg.filename_match_re.groups()
+	}
+	checkPosition := func(path string, position int, max int) {
+		if position < 0 || position > max {
+			fail(path, "position %d is out of range, lines only have groups 0 to %d", position, max)
+		}
+	}
+
+	for _, m := range lg.usedMappings() {
+		max_position := m.expected_matches + filename_groups
+
+		if m.date_format == "" {
+			fail(m.path+"date.format", "missing")
+		}
+		checkPosition(m.path+"date.position", m.date_position, max_position)
+
+		for tag, pos := range m.tags {
+			if position, ok := pos.(int); ok {
+				checkPosition(m.path+"tags."+tag, position, max_position)
+			}
+		}
+
+		for position, keyExtracts := range m.metrics {
+			for _, keyExtract := range keyExtracts {
+				path := fmt.Sprintf("%smetrics.%s.%s.reference", m.path, keyExtract.metric_type, keyExtract.key_suffix)
+				checkPosition(path, position, m.expected_matches)
+
+				for op, op_positions := range keyExtract.operations {
+					for _, op_position := range op_positions {
+						checkPosition(path+"."+op, op_position, m.expected_matches)
+					}
+				}
+			}
+		}
+
+		for position := range m.transform {
+			checkPosition(fmt.Sprintf("%stransform.%d", m.path, position), position, max_position)
+		}
+	}
+
+	return errs
+}
+
+func (conf *Config) check() ConfigErrors {
+	names := make([]string, 0, len(conf.logGroups))
+	for name := range conf.logGroups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var errs ConfigErrors
+	fail := func(path string, format string, v ...interface{}) {
+		errs = append(errs, newConfigError("", path, format, v...))
+	}
+
+	//Zero is replaced by the default, anything below 1 left is a mistake
+	if conf.pushWait < 1 {
+		fail("settings.push_wait", "must be at least 1, got %d", conf.pushWait)
+	}
+	if conf.pushMaxWait < conf.pushWait {
+		fail("settings.push_max_wait", "must be at least push_wait (%d), got %d", conf.pushWait, conf.pushMaxWait)
+	}
+	if conf.pushBackoffFactor < 1 {
+		fail("settings.push_backoff_factor", "must be at least 1, got %d", conf.pushBackoffFactor)
+	}
+	if conf.pushBreakerThreshold < 1 {
+		fail("settings.push_breaker_threshold", "must be at least 1, got %d", conf.pushBreakerThreshold)
+	}
+
+	for _, name := range names {
+		lg_errs := conf.logGroups[name].check()
+		lg_errs.sort()
+		errs = append(errs, lg_errs...)
+	}
+
+	return errs
+}
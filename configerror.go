@@ -0,0 +1,119 @@
+package logmetrics
+
+import (
+	"fmt"
+	"log"
+	"runtime/debug"
+	"sort"
+	"strings"
+)
+
+// A problem in the config file. Group is empty for the settings section,
+// Path is the key within the section, ie: metrics.meter[0].reference[1].
+type ConfigError struct {
+	Group string
+	Path  string
+	Msg   string
+}
+
+func newConfigError(group string, path string, format string, v ...interface{}) *ConfigError {
+	return &ConfigError{Group: group, Path: path, Msg: fmt.Sprintf(format, v...)}
+}
+
+func (e *ConfigError) Error() string {
+	if e.Group == "" {
+		return fmt.Sprintf("%s: %s", e.Path, e.Msg)
+	}
+	return fmt.Sprintf("log group %s, %s: %s", e.Group, e.Path, e.Msg)
+}
+
+// Every problem found by the checks run after parsing
+type ConfigErrors []*ConfigError
+
+func (errs ConfigErrors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+
+	return strings.Join(msgs, "\n")
+}
+
+func (errs ConfigErrors) sort() {
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Error() < errs[j].Error() })
+}
+
+// Parsing stops at the first error, it's recovered by LoadConfig and ParseConfig
+func configFail(group string, path string, format string, v ...interface{}) {
+	panic(newConfigError(group, path, format, v...))
+}
+
+// Deferred by ParseConfig. Any other panic is a bug, it's still turned into an error
+// so a SIGHUP reload keeps the running config instead of killing the collector.
+func recoverConfigError(configFile string, err *error) {
+	r := recover()
+	switch e := r.(type) {
+	case nil:
+	case *ConfigError:
+		*err = e
+	case ConfigErrors:
+		*err = e
+	default:
+		log.Printf("Unexpected error parsing %s: %v\n%s", configFile, r, debug.Stack())
+		*err = fmt.Errorf("%s: unexpected error: %v", configFile, r)
+	}
+}
+
+func describeType(val interface{}) string {
+	switch v := val.(type) {
+	case nil:
+		return "nothing"
+	case string:
+		return fmt.Sprintf("a string (%q)", v)
+	case int:
+		return fmt.Sprintf("an integer (%d)", v)
+	case float64:
+		return fmt.Sprintf("a float (%g)", v)
+	case bool:
+		return fmt.Sprintf("a boolean (%t)", v)
+	case []interface{}:
+		return "a list"
+	case map[interface{}]interface{}:
+		return "a map"
+	default:
+		return fmt.Sprintf("%T", v)
+	}
+}
+
+// For the few values left as interface{} by decoding, like metric references
+func toInt(group string, path string, val interface{}) int {
+	v, ok := val.(int)
+	if !ok {
+		configFail(group, path, "expected an integer, got %s", describeType(val))
+	}
+	return v
+}
+
+func toString(group string, path string, val interface{}) string {
+	v, ok := val.(string)
+	if !ok {
+		configFail(group, path, "expected a string, got %s", describeType(val))
+	}
+	return v
+}
+
+func toList(group string, path string, val interface{}) []interface{} {
+	v, ok := val.([]interface{})
+	if !ok {
+		configFail(group, path, "expected a list, got %s", describeType(val))
+	}
+	return v
+}
+
+func toMap(group string, path string, val interface{}) map[interface{}]interface{} {
+	v, ok := val.(map[interface{}]interface{})
+	if !ok {
+		configFail(group, path, "expected a map, got %s", describeType(val))
+	}
+	return v
+}
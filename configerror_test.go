@@ -0,0 +1,39 @@
+package logmetrics
+
+import (
+	"testing"
+)
+
+func parseWith(parse func()) (err error) {
+	defer recoverConfigError("test.yaml", &err)
+	parse()
+	return nil
+}
+
+func TestRecoverConfigError(t *testing.T) {
+	err := parseWith(func() { configFail("web", "re", "invalid regex") })
+	if e, ok := err.(*ConfigError); !ok || e.Group != "web" || e.Path != "re" {
+		t.Errorf("expected the config error back, got %#v", err)
+	}
+
+	err = parseWith(func() { panic(ConfigErrors{newConfigError("", "settings", "nope")}) })
+	if errs, ok := err.(ConfigErrors); !ok || len(errs) != 1 {
+		t.Errorf("expected the config errors back, got %#v", err)
+	}
+
+	//A bug while parsing, like a reload hitting a nil map
+	err = parseWith(func() {
+		var positions map[string]int
+		positions["a"] = 1
+	})
+	if err == nil {
+		t.Fatal("expected an unexpected panic to become an error")
+	}
+	if _, ok := err.(*ConfigError); ok {
+		t.Errorf("expected a plain error, got %#v", err)
+	}
+
+	if err = parseWith(func() {}); err != nil {
+		t.Errorf("expected no error, got %s", err)
+	}
+}
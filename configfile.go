@@ -0,0 +1,478 @@
+package logmetrics
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Layout of the config file. Every top level key other than settings is a log group.
+type fileConfig struct {
+	Settings  settingsConfig             `yaml:"settings"`
+	LogGroups map[string]*logGroupConfig `yaml:",inline"`
+}
+
+type settingsConfig struct {
+	PollInterval    int    `yaml:"poll_interval"`
+	LogFacility     string `yaml:"log_facility"`
+	StatsInterval   int    `yaml:"stats_interval"`
+	StateDir        string `yaml:"state_dir,omitempty"`
+	StateInterval   int    `yaml:"state_interval"`
+	ShutdownTimeout int    `yaml:"shutdown_timeout"`
+	Include         string `yaml:"include,omitempty"`
+
+	PushHost         string         `yaml:"push_host"`
+	PushPort         int            `yaml:"push_port,omitempty"`
+	PushHosts        []string       `yaml:"push_hosts,omitempty"`
+	PushProto        string         `yaml:"push_proto"`
+	PushType         string         `yaml:"push_type"`
+	PushTls          *tlsFileConfig `yaml:"push_tls,omitempty"`
+	PushStrategy     string         `yaml:"push_strategy"`
+	GraphiteTemplate string         `yaml:"graphite_template"`
+	InfluxDb         string         `yaml:"influx_db"`
+	KafkaTopic       string         `yaml:"kafka_topic"`
+
+	PushNumber           int  `yaml:"push_number"`
+	PushWait             int  `yaml:"push_wait"`
+	PushBatchSize        int  `yaml:"push_batch_size"`
+	PushRetries          int  `yaml:"push_retries"`
+	PushTimeout          int  `yaml:"push_timeout"`
+	PushFlushSize        int  `yaml:"push_flush_size"`
+	PushFlushIntervalMs  int  `yaml:"push_flush_interval_ms"`
+	PushLogErrors        bool `yaml:"push_log_errors"`
+	PushFailbackInterval int  `yaml:"push_failback_interval"`
+	PushMaxWait          int  `yaml:"push_max_wait"`
+	PushBackoffFactor    int  `yaml:"push_backoff_factor"`
+	PushBreakerThreshold int  `yaml:"push_breaker_threshold"`
+
+	Outputs []*outputFileConfig `yaml:"outputs,omitempty"`
+
+	PrometheusListen string `yaml:"prometheus_listen,omitempty"`
+	StatsdHost       string `yaml:"statsd_host"`
+	StatsdPort       int    `yaml:"statsd_port"`
+	StatsdDogstatsd  bool   `yaml:"statsd_dogstatsd"`
+
+	SpoolDir        string `yaml:"spool_dir,omitempty"`
+	SpoolMaxSizeMb  int    `yaml:"spool_max_size_mb"`
+	SpoolDropPolicy string `yaml:"spool_drop_policy"`
+}
+
+// Unset keys are taken from the top level push_* settings
+type outputFileConfig struct {
+	PushHost         string         `yaml:"push_host"`
+	PushPort         int            `yaml:"push_port,omitempty"`
+	PushHosts        []string       `yaml:"push_hosts,omitempty"`
+	PushProto        string         `yaml:"push_proto"`
+	PushType         string         `yaml:"push_type"`
+	PushTls          *tlsFileConfig `yaml:"push_tls,omitempty"`
+	PushStrategy     string         `yaml:"push_strategy"`
+	GraphiteTemplate string         `yaml:"graphite_template"`
+	InfluxDb         string         `yaml:"influx_db"`
+	KafkaTopic       string         `yaml:"kafka_topic"`
+}
+
+type tlsFileConfig struct {
+	CaFile             string `yaml:"ca_file,omitempty"`
+	CertFile           string `yaml:"cert_file,omitempty"`
+	KeyFile            string `yaml:"key_file,omitempty"`
+	ServerName         string `yaml:"server_name,omitempty"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+}
+
+type logGroupConfig struct {
+	Files           []string      `yaml:"files"`
+	FilenameMatch   string        `yaml:"filename_match,omitempty"`
+	Format          string        `yaml:"format"`
+	Re              []regexConfig `yaml:"re"`
+	RegexEngine     string        `yaml:"regex_engine"`
+	ExpectedMatches int           `yaml:"expected_matches"`
+	Date            dateConfig    `yaml:"date"`
+
+	KeyPrefix string                           `yaml:"key_prefix"`
+	Tags      map[string]interface{}           `yaml:"tags"`
+	Metrics   map[string][]*metricConfig       `yaml:"metrics"`
+	Transform map[interface{}]*transformConfig `yaml:"transform,omitempty"`
+
+	HistogramSize                int     `yaml:"histogram_size"`
+	HistogramAlphaDecay          float64 `yaml:"histogram_alpha_decay"`
+	HistogramRescaleThresholdMin int     `yaml:"histogram_rescale_threshold_min"`
+	EwmaInterval                 int     `yaml:"ewma_interval"`
+	StaleRemoval                 bool    `yaml:"stale_removal"`
+	StaleTresholdMin             int     `yaml:"stale_treshold_min"`
+	SendDuplicates               bool    `yaml:"send_duplicates"`
+
+	Goroutines int  `yaml:"goroutines"`
+	Interval   int  `yaml:"interval"`
+	PollFile   bool `yaml:"poll_file"`
+	LivePoll   bool `yaml:"live_poll"`
+
+	WarnOnOperationFail  bool `yaml:"warn_on_operation_fail"`
+	WarnOnRegexFail      bool `yaml:"warn_on_regex_fail"`
+	WarnOnOutOfOrderTime bool `yaml:"warn_on_out_of_order_time"`
+	LogStaleMetrics      bool `yaml:"log_stale_metrics"`
+	ParseFromStart       bool `yaml:"parse_from_start"`
+	StatsdPassthrough    bool `yaml:"statsd_passthrough"`
+}
+
+// A regex of re, either just the pattern or a map with its own tags, date and metrics.
+// What's left out of the map comes from the log group.
+type regexConfig struct {
+	Re              string                     `yaml:"re"`
+	ExpectedMatches int                        `yaml:"expected_matches,omitempty"`
+	Date            *dateConfig                `yaml:"date,omitempty"`
+	Tags            map[string]interface{}     `yaml:"tags,omitempty"`
+	Metrics         map[string][]*metricConfig `yaml:"metrics,omitempty"`
+}
+
+func (r *regexConfig) hasMapping() bool {
+	return r.ExpectedMatches != 0 || r.Date != nil || r.Tags != nil || r.Metrics != nil
+}
+
+func (r *regexConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if err := unmarshal(&r.Re); err == nil {
+		return nil
+	}
+
+	type plainRegex regexConfig
+	return unmarshal((*plainRegex)(r))
+}
+
+func (r regexConfig) MarshalYAML() (interface{}, error) {
+	if !r.hasMapping() {
+		return r.Re, nil
+	}
+
+	type plainRegex regexConfig
+	return plainRegex(r), nil
+}
+
+type dateConfig struct {
+	Position interface{} `yaml:"position"`
+	Format   string      `yaml:"format"`
+}
+
+type metricConfig struct {
+	KeySuffix  string `yaml:"key_suffix"`
+	Format     string `yaml:"format"`
+	Multiply   int    `yaml:"multiply"`
+	Divide     int    `yaml:"divide"`
+	NeverStale bool   `yaml:"never_stale"`
+
+	//[position, tag] or [position, tag, {add: [...], sub: [...]}], checked by parseMetrics
+	Reference [][]interface{} `yaml:"reference"`
+}
+
+type transformConfig struct {
+	ReplaceOnlyOne   bool       `yaml:"replace_only_one"`
+	LogDefaultAssign bool       `yaml:"log_default_assign"`
+	Operations       [][]string `yaml:"operations"`
+}
+
+// Defaults of settings left out or set to 0
+func (s *settingsConfig) setDefaults() {
+	if s.PollInterval == 0 {
+		s.PollInterval = 15
+	}
+	if s.LogFacility == "" {
+		s.LogFacility = "local0"
+	}
+	if s.PushHost == "" {
+		s.PushHost = "localhost"
+	}
+	if s.PushProto == "" {
+		s.PushProto = "udp"
+	}
+	if s.PushType == "" {
+		s.PushType = "tcollector"
+	}
+	if s.PushNumber == 0 {
+		s.PushNumber = 1
+	}
+	if s.PushBatchSize == 0 {
+		s.PushBatchSize = 50
+	}
+	if s.PushRetries == 0 {
+		s.PushRetries = 3
+	}
+	if s.PushTimeout == 0 {
+		s.PushTimeout = 10
+	}
+	if s.PushFlushSize == 0 {
+		s.PushFlushSize = 32 * 1024
+	}
+	if s.PushFlushIntervalMs == 0 {
+		s.PushFlushIntervalMs = 1000
+	}
+	if s.StatsInterval == 0 {
+		s.StatsInterval = 60
+	}
+	if s.StateInterval == 0 {
+		s.StateInterval = 30
+	}
+	if s.GraphiteTemplate == "" {
+		s.GraphiteTemplate = "{metric}"
+	}
+	if s.InfluxDb == "" {
+		s.InfluxDb = "logmetrics"
+	}
+	if s.KafkaTopic == "" {
+		s.KafkaTopic = "logmetrics"
+	}
+	if s.StatsdHost == "" {
+		s.StatsdHost = "localhost"
+	}
+	if s.StatsdPort == 0 {
+		s.StatsdPort = 8125
+	}
+	if s.SpoolMaxSizeMb == 0 {
+		s.SpoolMaxSizeMb = 1024
+	}
+	if s.SpoolDropPolicy == "" {
+		s.SpoolDropPolicy = "drop_oldest"
+	}
+	if s.ShutdownTimeout == 0 {
+		s.ShutdownTimeout = 30
+	}
+	if s.PushStrategy == "" {
+		s.PushStrategy = "failover"
+	}
+	if s.PushFailbackInterval == 0 {
+		s.PushFailbackInterval = 60
+	}
+	if s.PushWait == 0 {
+		s.PushWait = 5
+	}
+	if s.PushMaxWait == 0 {
+		s.PushMaxWait = 300
+	}
+	if s.PushBackoffFactor == 0 {
+		s.PushBackoffFactor = 2
+	}
+	if s.PushBreakerThreshold == 0 {
+		s.PushBreakerThreshold = 5
+	}
+}
+
+// Every key left out of an output comes from the top level settings
+func (o *outputFileConfig) setDefaults(s *settingsConfig) {
+	if o.PushHost == "" {
+		o.PushHost = s.PushHost
+	}
+	if o.PushPort == 0 {
+		o.PushPort = s.PushPort
+	}
+	if o.PushHosts == nil {
+		o.PushHosts = s.PushHosts
+	}
+	if o.PushProto == "" {
+		o.PushProto = s.PushProto
+	}
+	if o.PushType == "" {
+		o.PushType = s.PushType
+	}
+	if o.PushTls == nil {
+		o.PushTls = s.PushTls
+	}
+	if o.PushStrategy == "" {
+		o.PushStrategy = s.PushStrategy
+	}
+	if o.GraphiteTemplate == "" {
+		o.GraphiteTemplate = s.GraphiteTemplate
+	}
+	if o.InfluxDb == "" {
+		o.InfluxDb = s.InfluxDb
+	}
+	if o.KafkaTopic == "" {
+		o.KafkaTopic = s.KafkaTopic
+	}
+}
+
+func (lg *logGroupConfig) setDefaults() {
+	if lg.Format == "" {
+		lg.Format = "regex"
+	}
+	if lg.RegexEngine == "" {
+		lg.RegexEngine = defaultRegexEngine()
+	}
+	if lg.Goroutines == 0 {
+		lg.Goroutines = 1
+	}
+	if lg.HistogramAlphaDecay == 0 {
+		lg.HistogramAlphaDecay = 0.15
+	}
+	if lg.HistogramSize == 0 {
+		lg.HistogramSize = 256
+	}
+	if lg.HistogramRescaleThresholdMin == 0 {
+		lg.HistogramRescaleThresholdMin = 60
+	}
+	if lg.EwmaInterval == 0 {
+		lg.EwmaInterval = 30
+	}
+	if lg.StaleTresholdMin == 0 {
+		lg.StaleTresholdMin = 60
+	}
+}
+
+// Defaults are set before decoding so an explicit multiply or divide of 0 is still caught
+func (m *metricConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain metricConfig
+	*m = metricConfig{Format: "int", Multiply: 1, Divide: 1}
+
+	return unmarshal((*plain)(m))
+}
+
+// Reads the config file and the log groups of its includes, rejecting unknown
+// keys and values of the wrong type
+func readConfigFile(configFile string) *fileConfig {
+	var fc fileConfig
+	decodeConfigFile(configFile, &fc)
+
+	vars := newConfigVars()
+	if errs := vars.expandConfig(&fc); len(errs) > 0 {
+		panic(errs)
+	}
+
+	fc.Settings.setDefaults()
+	if fc.LogGroups == nil {
+		fc.LogGroups = make(map[string]*logGroupConfig)
+	}
+
+	if fc.Settings.Include != "" {
+		readIncludes(configFile, &fc, vars)
+	}
+
+	for name, lg := range fc.LogGroups {
+		if lg == nil {
+			configFail(name, "log group", "empty")
+		}
+		lg.setDefaults()
+	}
+
+	return &fc
+}
+
+// Included files only define log groups
+type includeFileConfig struct {
+	Settings  interface{}                `yaml:"settings"`
+	LogGroups map[string]*logGroupConfig `yaml:",inline"`
+}
+
+func readIncludes(configFile string, fc *fileConfig, vars *configVars) {
+	//Relative to the main config file
+	pattern := fc.Settings.Include
+	if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(filepath.Dir(configFile), pattern)
+	}
+
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		configFail("", "settings.include", "invalid glob %s: %s", fc.Settings.Include, err)
+	}
+
+	defined_in := make(map[string]string)
+	for name := range fc.LogGroups {
+		defined_in[name] = configFile
+	}
+
+	var errs ConfigErrors
+	for _, file := range files {
+		var ic includeFileConfig
+		decodeConfigFile(file, &ic)
+		errs = append(errs, vars.expandConfig(&ic)...)
+
+		if ic.Settings != nil {
+			errs = append(errs, newConfigError("", file+" settings", "only allowed in the main config file %s", configFile))
+		}
+
+		for name, lg := range ic.LogGroups {
+			if previous, found := defined_in[name]; found {
+				errs = append(errs, newConfigError("", file, "log group %s is already defined in %s", name, previous))
+				continue
+			}
+
+			defined_in[name] = file
+			fc.LogGroups[name] = lg
+		}
+	}
+
+	if len(errs) > 0 {
+		errs.sort()
+		panic(errs)
+	}
+}
+
+func decodeConfigFile(file string, v interface{}) {
+	byteConfig, err := ioutil.ReadFile(file)
+	if err != nil {
+		configFail("", file, "%s", err)
+	}
+
+	if err := yaml.UnmarshalStrict(byteConfig, v); err != nil {
+		panic(yamlErrors(file, err))
+	}
+}
+
+// Go type names as they'd show up in yaml errors
+var yamlTypeNames = strings.NewReplacer(
+	"logmetrics.settingsConfig", "settings",
+	"logmetrics.includeFileConfig", "include file",
+	"*logmetrics.outputFileConfig", "output",
+	"logmetrics.outputFileConfig", "output",
+	"*logmetrics.tlsFileConfig", "push_tls",
+	"logmetrics.tlsFileConfig", "push_tls",
+	"*logmetrics.logGroupConfig", "log group",
+	"logmetrics.logGroupConfig", "log group",
+	"logmetrics.plainRegex", "re",
+	"*logmetrics.regexConfig", "re",
+	"logmetrics.plain", "metric",
+	"*logmetrics.metricConfig", "metric",
+	"*logmetrics.transformConfig", "transform",
+	"logmetrics.transformConfig", "transform",
+	"*logmetrics.dateConfig", "date",
+	"logmetrics.dateConfig", "date",
+)
+
+var yamlLineRe = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+
+// yaml reports every decoding problem at once, with the line it's on
+func yamlErrors(configFile string, err error) ConfigErrors {
+	var msgs []string
+	if terr, ok := err.(*yaml.TypeError); ok {
+		msgs = terr.Errors
+	} else {
+		msgs = []string{err.Error()}
+	}
+
+	errs := make(ConfigErrors, len(msgs))
+	for i, msg := range msgs {
+		msg = yamlTypeNames.Replace(msg)
+		if m := yamlLineRe.FindStringSubmatch(msg); m != nil {
+			errs[i] = newConfigError("", configFile+" line "+m[1], "%s", m[2])
+		} else {
+			errs[i] = newConfigError("", configFile, "%s", msg)
+		}
+	}
+
+	return errs
+}
+
+func marshalConfig(v interface{}) string {
+	out, err := yaml.Marshal(v)
+	if err != nil {
+		configFail("", "config", "unable to marshal: %s", err)
+	}
+	return string(out)
+}
+
+// The config as it's used, with every default filled in. It can be read back as is.
+// Included log groups are part of it, include itself is left out.
+func (conf *Config) Dump() string {
+	fc := *conf.file
+	fc.Settings.Include = ""
+
+	return marshalConfig(&fc)
+}
@@ -0,0 +1,122 @@
+package logmetrics
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func writeConfigFile(t *testing.T, dir string, name string, content string) string {
+	filename := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(filename, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return filename
+}
+
+// Errors without the temporary directory, ie: "main.yaml line 2: field push_prot not found in type settings"
+func getConfigErrorMsgs(t *testing.T, err error, dir string) []string {
+	errs, ok := err.(ConfigErrors)
+	if !ok {
+		t.Fatalf("expected config errors, got %#v", err)
+	}
+
+	msgs := make([]string, len(errs))
+	for i, e := range errs {
+		msgs[i] = strings.Replace(e.Error(), dir+string(filepath.Separator), "", -1)
+	}
+
+	return msgs
+}
+
+func TestReadConfigFileIsStrict(t *testing.T) {
+	dir := t.TempDir()
+	filename := writeConfigFile(t, dir, "main.yaml", `settings:
+  push_prot: tcp
+  push_port: "4242"
+web:
+  key_prefix: web
+  fils: ["/var/log/web.log"]
+`)
+
+	//Every problem at once, with the line it's on
+	err := parseWith(func() { readConfigFile(filename) })
+	expected := []string{
+		"main.yaml line 2: field push_prot not found in type settings",
+		"main.yaml line 3: cannot unmarshal !!str `4242` into int",
+		"main.yaml line 6: field fils not found in type log group",
+	}
+	if msgs := getConfigErrorMsgs(t, err, dir); !reflect.DeepEqual(msgs, expected) {
+		t.Errorf("expected %q, got %q", expected, msgs)
+	}
+
+	filename = writeConfigFile(t, dir, "main.yaml", `settings:
+  push_proto: tcp
+  push_port: 4242
+web:
+  key_prefix: web
+  files: ["/var/log/web.log"]
+`)
+	var fc *fileConfig
+	if err := parseWith(func() { fc = readConfigFile(filename) }); err != nil {
+		t.Fatalf("expected a valid config, got %s", err)
+	}
+	if fc.Settings.PushPort != 4242 || fc.LogGroups["web"].KeyPrefix != "web" {
+		t.Errorf("unexpected config %+v", fc)
+	}
+}
+
+func TestReadIncludes(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "conf.d"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	//Relative to the main config file
+	filename := writeConfigFile(t, dir, "main.yaml", `settings:
+  include: conf.d/*.yaml
+web:
+  key_prefix: web
+  files: ["/var/log/web.log"]
+`)
+	writeConfigFile(t, dir, "conf.d/api.yaml", `api:
+  key_prefix: api
+  files: ["/var/log/api.log"]
+`)
+	writeConfigFile(t, dir, "conf.d/ignored.yml", `web:
+  key_prefix: other
+`)
+
+	var fc *fileConfig
+	if err := parseWith(func() { fc = readConfigFile(filename) }); err != nil {
+		t.Fatalf("expected the includes to be merged, got %s", err)
+	}
+	if len(fc.LogGroups) != 2 || fc.LogGroups["web"].KeyPrefix != "web" || fc.LogGroups["api"].KeyPrefix != "api" {
+		t.Fatalf("unexpected log groups %+v", fc.LogGroups)
+	}
+	if fc.LogGroups["api"].Goroutines != 1 {
+		t.Errorf("expected the defaults to be set on included log groups")
+	}
+
+	//Each file's problems are reported together
+	writeConfigFile(t, dir, "conf.d/web.yaml", `settings:
+  push_port: 4242
+web:
+  key_prefix: web2
+api:
+  key_prefix: api2
+`)
+	err := parseWith(func() { readConfigFile(filename) })
+	expected := []string{
+		"conf.d/web.yaml settings: only allowed in the main config file main.yaml",
+		"conf.d/web.yaml: log group api is already defined in conf.d/api.yaml",
+		"conf.d/web.yaml: log group web is already defined in main.yaml",
+	}
+	if msgs := getConfigErrorMsgs(t, err, dir); !reflect.DeepEqual(msgs, expected) {
+		t.Errorf("expected %q, got %q", expected, msgs)
+	}
+}
@@ -0,0 +1,152 @@
+package logmetrics
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// Variables usable in every string of the config file:
+//
+//	${NAME}            hostname or the environment variable NAME
+//	${NAME:-default}   default when NAME isn't set or is empty
+//	$${                a literal ${
+type configVars struct {
+	vars map[string]string
+}
+
+var configVarRe = regexp.MustCompile(`\$\$\{|\$\{([^}]*)\}|\$\{`)
+var configVarNameRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+func newConfigVars() *configVars {
+	return &configVars{vars: map[string]string{"hostname": getHostname()}}
+}
+
+func (cv *configVars) lookup(name string) string {
+	if val, found := cv.vars[name]; found {
+		return val
+	}
+	return os.Getenv(name)
+}
+
+// Returns the expanded string and what couldn't be expanded
+func (cv *configVars) expand(s string) (string, []string) {
+	var problems []string
+
+	expanded := configVarRe.ReplaceAllStringFunc(s, func(m string) string {
+		switch {
+		case m == "$${":
+			return "${"
+		case m == "${":
+			problems = append(problems, "unterminated ${")
+			return m
+		}
+
+		name, default_val, has_default := m[2:len(m)-1], "", false
+		if i := strings.Index(name, ":-"); i >= 0 {
+			name, default_val, has_default = name[:i], name[i+2:], true
+		}
+
+		if !configVarNameRe.MatchString(name) {
+			problems = append(problems, fmt.Sprintf("invalid variable %s", m))
+			return m
+		}
+
+		if val := cv.lookup(name); val != "" {
+			return val
+		} else if has_default {
+			return default_val
+		}
+
+		problems = append(problems, fmt.Sprintf("unresolved variable %s", m))
+		return m
+	})
+
+	return expanded, problems
+}
+
+// Expands every string of a decoded config, yaml keys are left as is
+func (cv *configVars) expandConfig(conf interface{}) ConfigErrors {
+	var errs ConfigErrors
+	cv.expandValue(reflect.ValueOf(conf), "", "", &errs)
+	errs.sort()
+
+	return errs
+}
+
+func (cv *configVars) expandString(s string, group string, path string, errs *ConfigErrors) string {
+	expanded, problems := cv.expand(s)
+	for _, problem := range problems {
+		*errs = append(*errs, newConfigError(group, path, "%s", problem))
+	}
+
+	return expanded
+}
+
+func (cv *configVars) expandValue(v reflect.Value, group string, path string, errs *ConfigErrors) {
+	switch v.Kind() {
+	case reflect.String:
+		if v.CanSet() {
+			v.SetString(cv.expandString(v.String(), group, path, errs))
+		}
+
+	case reflect.Ptr:
+		if !v.IsNil() {
+			cv.expandValue(v.Elem(), group, path, errs)
+		}
+
+	case reflect.Interface:
+		if v.IsNil() {
+			return
+		}
+		if s, ok := v.Interface().(string); ok && v.CanSet() {
+			v.Set(reflect.ValueOf(cv.expandString(s, group, path, errs)))
+		} else {
+			cv.expandValue(v.Elem(), group, path, errs)
+		}
+
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			tag := strings.Split(v.Type().Field(i).Tag.Get("yaml"), ",")
+			field := v.Field(i)
+
+			//Log groups, the key is the group name
+			if len(tag) > 1 && tag[1] == "inline" {
+				for _, key := range field.MapKeys() {
+					cv.expandValue(field.MapIndex(key), key.String(), "", errs)
+				}
+				continue
+			}
+
+			cv.expandValue(field, group, joinConfigPath(path, tag[0]), errs)
+		}
+
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			cv.expandValue(v.Index(i), group, fmt.Sprintf("%s[%d]", path, i), errs)
+		}
+
+	case reflect.Map:
+		for _, key := range v.MapKeys() {
+			val := v.MapIndex(key)
+			val_path := joinConfigPath(path, fmt.Sprint(key.Interface()))
+
+			//Map values can't be set in place
+			if s, ok := val.Interface().(string); ok {
+				expanded := reflect.ValueOf(cv.expandString(s, group, val_path, errs))
+				v.SetMapIndex(key, expanded.Convert(val.Type()))
+			} else {
+				cv.expandValue(val, group, val_path, errs)
+			}
+		}
+	}
+}
+
+func joinConfigPath(path string, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
@@ -0,0 +1,57 @@
+package logmetrics
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestConfigVarsExpand(t *testing.T) {
+	t.Setenv("LM_TEST_DC", "east")
+	t.Setenv("LM_TEST_EMPTY", "")
+	cv := &configVars{vars: map[string]string{"hostname": "web1"}}
+
+	tests := []struct {
+		s        string
+		expected string
+		problems []string
+	}{
+		{"/var/log/${LM_TEST_DC}/app.log", "/var/log/east/app.log", nil},
+		{"${hostname}.${LM_TEST_DC}", "web1.east", nil},
+		{"${LM_TEST_UNSET:-west}", "west", nil},
+		{"${LM_TEST_EMPTY:-west}", "west", nil},
+		{"${LM_TEST_DC:-west}", "east", nil},
+		{"${LM_TEST_UNSET:-}x", "x", nil},
+		//Left as is and reported
+		{"${LM_TEST_UNSET}", "${LM_TEST_UNSET}", []string{"unresolved variable ${LM_TEST_UNSET}"}},
+		{"${LM_TEST_EMPTY}", "${LM_TEST_EMPTY}", []string{"unresolved variable ${LM_TEST_EMPTY}"}},
+		{"${LM-TEST}", "${LM-TEST}", []string{"invalid variable ${LM-TEST}"}},
+		{"${LM_TEST_DC", "${LM_TEST_DC", []string{"unterminated ${"}},
+		//Escaping
+		{"$${LM_TEST_DC}", "${LM_TEST_DC}", nil},
+		{"$$${LM_TEST_DC}", "$${LM_TEST_DC}", nil},
+		{"$LM_TEST_DC and $", "$LM_TEST_DC and $", nil},
+	}
+
+	for _, test := range tests {
+		expanded, problems := cv.expand(test.s)
+		if expanded != test.expected || !reflect.DeepEqual(problems, test.problems) {
+			t.Errorf("%s: expected %q %q, got %q %q", test.s, test.expected, test.problems, expanded, problems)
+		}
+	}
+}
+
+func TestConfigVarsExpandConfig(t *testing.T) {
+	t.Setenv("LM_TEST_DC", "east")
+	cv := &configVars{vars: map[string]string{"hostname": "web1"}}
+
+	fc := fileConfig{Settings: settingsConfig{PushHost: "tsd.${LM_TEST_DC}"},
+		LogGroups: map[string]*logGroupConfig{"web": {KeyPrefix: "web.${LM_TEST_UNSET}", Files: []string{"/var/log/${hostname}.log"}}}}
+
+	errs := cv.expandConfig(&fc)
+	if len(errs) != 1 || errs[0].Error() != "log group web, key_prefix: unresolved variable ${LM_TEST_UNSET}" {
+		t.Errorf("expected the unresolved variable to be reported with its path, got %v", errs)
+	}
+	if fc.Settings.PushHost != "tsd.east" || fc.LogGroups["web"].Files[0] != "/var/log/web1.log" {
+		t.Errorf("unexpected expanded config %+v %+v", fc.Settings, fc.LogGroups["web"])
+	}
+}
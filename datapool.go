@@ -3,7 +3,6 @@ package logmetrics
 import (
 	"fmt"
 	"log"
-	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -16,6 +15,11 @@ type dataPoint struct {
 	value       int64
 	never_stale bool
 	metric_type string
+
+	//Parts of name, for outputs that don't use it as is
+	base string
+	tags []string
+	tag  string
 }
 
 type dataPointTime struct {
@@ -25,6 +29,7 @@ type dataPointTime struct {
 
 type tsdPoint struct {
 	data               timemetrics.Metric
+	metric_type        string
 	filename           string
 	last_push          time.Time
 	last_crunched_push time.Time
@@ -45,36 +50,52 @@ type datapool struct {
 	channel_number     int
 	tsd_channel_number int
 
-	tag_order []string
-
 	lg *logGroup
 
 	total_keys     int
 	total_stale    int
 	last_time_file map[string]fileInfo
 
-	Bye chan bool
+	state_file     string
+	state_interval int
+
+	snapshots      *snapshotRegistry
+	last_snapshots map[string]metricSnapshot
+
+	statsd *statsdClient
+
+	Bye  chan bool
+	done chan bool
 }
 
-func (dp *datapool) compileTagOrder() {
-	tag_order := make([]string, dp.lg.getNbTags())
-	i := 0
-	for tagname, _ := range dp.lg.tags {
-		tag_order[i] = tagname
-		i++
+// nil for an unknown metric type
+func (dp *datapool) newMetric(metric_type string, t time.Time) timemetrics.Metric {
+	switch metric_type {
+	case "histogram":
+		s := timemetrics.NewExpDecaySample(t, dp.lg.histogram_size, dp.lg.histogram_alpha_decay, dp.lg.histogram_rescale_threshold_min)
+		return timemetrics.NewHistogram(s, dp.lg.stale_treshold_min)
+	case "counter":
+		return timemetrics.NewCounter(t, dp.lg.stale_treshold_min)
+	case "meter":
+		return timemetrics.NewMeter(t, dp.lg.ewma_interval, dp.lg.stale_treshold_min)
 	}
-	sort.Strings(tag_order)
 
-	dp.tag_order = tag_order
+	return nil
 }
 
-func (dp *datapool) extractTags(data []string) []string {
+// Returns once the lines already read are processed and the last keys pushed
+func (dp *datapool) Stop() {
+	dp.Bye <- true
+	<-dp.done
+}
+
+func (dp *datapool) extractTags(m *lineMapping, data []string) []string {
 	//General tags
-	tags := make([]string, dp.lg.getNbTags())
-	for cnt, tagname := range dp.tag_order {
+	tags := make([]string, m.getNbTags())
+	for cnt, tagname := range m.tag_order {
 
 		tag_value := ""
-		pos_or_value := dp.lg.tags[tagname]
+		pos_or_value := m.tags[tagname]
 
 		switch pos_or_string := pos_or_value.(type) {
 		case int:
@@ -99,11 +120,12 @@ func build_replace_map(data []string) map[string]string {
 	return r
 }
 
-func (dp *datapool) applyTransforms(match_groups []string) []string {
+// Transforms of the mapping the line was matched with
+func (dp *datapool) applyTransforms(m *lineMapping, match_groups []string) []string {
 	transformed_matches := make([]string, len(match_groups))
 
 	for pos, data := range match_groups {
-		if transform, ok := dp.lg.transform[pos]; ok {
+		if transform, ok := m.transform[pos]; ok {
 			transformed_matches[pos] = transform.apply(data)
 		} else {
 			transformed_matches[pos] = data
@@ -113,16 +135,16 @@ func (dp *datapool) applyTransforms(match_groups []string) []string {
 	return transformed_matches
 }
 
-func (dp *datapool) getKeys(data []string) ([]dataPoint, time.Time) {
+func (dp *datapool) getKeys(m *lineMapping, data []string) ([]dataPoint, time.Time) {
 	y := time.Now().Year()
 
-	tags := dp.extractTags(data)
+	tags := dp.extractTags(m, data)
 
-	nbKeys := dp.lg.getNbKeys()
+	nbKeys := m.getNbKeys()
 	dataPoints := make([]dataPoint, nbKeys)
 
 	//Time
-	t, err := time.Parse(dp.lg.date_format, data[dp.lg.date_position])
+	t, err := time.Parse(m.date_format, data[m.date_position])
 	if err != nil {
 		log.Print(err)
 		var nt time.Time
@@ -136,8 +158,8 @@ func (dp *datapool) getKeys(data []string) ([]dataPoint, time.Time) {
 	}
 
 	//Make a first pass extracting the data, applying float->int conversion on multiplier
-	values := make([]int64, dp.lg.expected_matches+1)
-	for position, keyTypes := range dp.lg.metrics {
+	values := make([]int64, m.expected_matches+1)
+	for position, keyTypes := range m.metrics {
 		for _, keyType := range keyTypes {
 			if position == 0 {
 				values[position] = 1
@@ -180,7 +202,7 @@ func (dp *datapool) getKeys(data []string) ([]dataPoint, time.Time) {
 	var i = 0
 	for position, val := range values {
 		//Is the value a metric?
-		for _, keyType := range dp.lg.metrics[position] {
+		for _, keyType := range m.metrics[position] {
 			//Key name
 			key := fmt.Sprintf("%s.%s.%s %s %s", dp.lg.key_prefix, keyType.key_suffix, "%s %d %s", strings.Join(tags, " "), keyType.tag)
 
@@ -206,7 +228,8 @@ func (dp *datapool) getKeys(data []string) ([]dataPoint, time.Time) {
 				return nil, nt
 			}
 
-			dataPoints[i] = dataPoint{name: key, value: val, metric_type: keyType.metric_type, never_stale: keyType.never_stale}
+			dataPoints[i] = dataPoint{name: key, value: val, metric_type: keyType.metric_type, never_stale: keyType.never_stale,
+				base: dp.lg.key_prefix + "." + keyType.key_suffix, tags: tags, tag: keyType.tag}
 			i++
 		}
 	}
@@ -225,15 +248,60 @@ func (dp *datapool) getStatsKey(timePush time.Time) []string {
 func (dp *datapool) start() {
 	log.Printf("Datapool[%s:%d] started. Pushing keys to TsdPusher[%d]", dp.lg.name, dp.channel_number, dp.tsd_channel_number)
 
+	//Checkpoint metric state in real time, log time can stand still
+	var checkpoint <-chan time.Time
+	if dp.state_file != "" {
+		ticker := time.NewTicker(time.Duration(dp.state_interval) * time.Second)
+		defer ticker.Stop()
+		checkpoint = ticker.C
+	}
+
+	defer close(dp.done)
+
 	var last_time_pushed *time.Time
 	var lastTimeStatsPushed time.Time
+	var last_point_time time.Time
+	stopping := false
 	for {
+		//Tailers are stopped first, once their lines are all processed push what's left
+		if stopping && len(dp.tail_data) == 0 {
+			if dp.statsd != nil {
+				dp.statsd.close()
+			} else if !last_point_time.IsZero() {
+				var nb_stale int
+				dp.total_keys, nb_stale = dp.pushKeys(last_point_time)
+				dp.total_stale += nb_stale
+				dp.tsd_push <- dp.getStatsKey(last_point_time)
+			}
+			if dp.state_file != "" {
+				if err := dp.saveState(); err != nil {
+					log.Printf("Datapool[%s:%d] unable to save state to %s: %s", dp.lg.name, dp.channel_number, dp.state_file, err)
+				}
+			}
+			if dp.snapshots != nil {
+				dp.snapshots.remove(fmt.Sprintf("%s:%d", dp.lg.name, dp.channel_number))
+			}
+			log.Printf("Datapool[%s:%d] stopped.", dp.lg.name, dp.channel_number)
+			return
+		}
+
 		select {
 		case line_result := <-dp.tail_data:
 
-			transformed_matches := dp.applyTransforms(line_result.matches)
+			mapping := dp.lg.mappings[line_result.re_index]
+			transformed_matches := dp.applyTransforms(mapping, line_result.matches)
 
-			data_points, point_time := dp.getKeys(transformed_matches)
+			data_points, point_time := dp.getKeys(mapping, transformed_matches)
+
+			//Passthrough mode, StatsD does the aggregation
+			if dp.statsd != nil {
+				dp.statsd.sendDataPoints(data_points)
+				continue
+			}
+
+			if point_time.After(last_point_time) {
+				last_point_time = point_time
+			}
 
 			if currentFileInfo, ok := dp.last_time_file[line_result.filename]; ok {
 				if currentFileInfo.lastUpdate.Before(point_time) {
@@ -251,20 +319,11 @@ func (dp *datapool) start() {
 			for _, data_point := range data_points {
 				//New metrics, add
 				if _, ok := dp.data[data_point.name]; !ok {
-					switch data_point.metric_type {
-					case "histogram":
-						s := timemetrics.NewExpDecaySample(point_time, dp.lg.histogram_size, dp.lg.histogram_alpha_decay, dp.lg.histogram_rescale_threshold_min)
-						dp.data[data_point.name] = &tsdPoint{data: timemetrics.NewHistogram(s, dp.lg.stale_treshold_min),
-							filename: line_result.filename}
-					case "counter":
-						dp.data[data_point.name] = &tsdPoint{data: timemetrics.NewCounter(point_time, dp.lg.stale_treshold_min),
-							filename: line_result.filename}
-					case "meter":
-						dp.data[data_point.name] = &tsdPoint{data: timemetrics.NewMeter(point_time, dp.lg.ewma_interval, dp.lg.stale_treshold_min),
-							filename: line_result.filename}
-					default:
+					data := dp.newMetric(data_point.metric_type, point_time)
+					if data == nil {
 						log.Fatalf("Unexpected metric type %s!", data_point.metric_type)
 					}
+					dp.data[data_point.name] = &tsdPoint{data: data, metric_type: data_point.metric_type, filename: line_result.filename}
 				}
 
 				//Make sure data is ordered or we risk sending duplicate data
@@ -305,9 +364,12 @@ func (dp *datapool) start() {
 
 				last_time_pushed = &point_time
 			}
+		case <-checkpoint:
+			if err := dp.saveState(); err != nil {
+				log.Printf("Datapool[%s:%d] unable to save state to %s: %s", dp.lg.name, dp.channel_number, dp.state_file, err)
+			}
 		case <-dp.Bye:
-			log.Printf("Datapool[%s:%d] stopped.", dp.lg.name, dp.channel_number)
-			return
+			stopping = true
 		}
 	}
 }
@@ -327,6 +389,9 @@ func (dp *datapool) pushKeys(point_time time.Time) (int, int) {
 			//Push the zeroed-out key one last time to stabilize aggregated data
 			pointData.ZeroOut()
 			delete(dp.data, tsd_key)
+			if dp.last_snapshots != nil {
+				delete(dp.last_snapshots, tsd_key)
+			}
 			nbStale += pointData.NbKeys()
 		} else {
 			nbKeys += pointData.NbKeys()
@@ -356,27 +421,51 @@ func (dp *datapool) pushKeys(point_time time.Time) (int, int) {
 
 		dp.tsd_push <- keys
 
+		if dp.last_snapshots != nil && len(keys) > 0 && dp.data[tsd_key] != nil {
+			dp.last_snapshots[tsd_key] = metricSnapshot{metric_type: tsdPoint.metric_type, base: getKeyBase(tsd_key), lines: keys}
+		}
+
 		if currentFileInfo.last_push.After(dp.last_time_file[tsdPoint.filename].last_push) {
 			dp.last_time_file[tsdPoint.filename] = currentFileInfo
 		}
 	}
 
+	dp.publishSnapshots()
+
 	return nbKeys, nbStale
 }
 
-func StartDataPools(config *Config, tsd_pushers []chan []string) (dps []*datapool) {
-	//Start a queryHandler by log group
-	nb_tsd_push := 0
-	dps = make([]*datapool, 0)
-	for _, lg := range config.logGroups {
-		for i := 0; i < lg.goroutines; i++ {
-			dp := lg.CreateDataPool(i, tsd_pushers, nb_tsd_push)
-			go dp.start()
-			dps = append(dps, dp)
-
-			nb_tsd_push = (nb_tsd_push + 1) % config.GetPusherNumber()
+func (dp *datapool) publishSnapshots() {
+	if dp.snapshots == nil {
+		return
+	}
+
+	snapshots := make(map[string]metricSnapshot, len(dp.last_snapshots))
+	for tsd_key, snapshot := range dp.last_snapshots {
+		snapshots[tsd_key] = snapshot
+	}
+
+	dp.snapshots.publish(fmt.Sprintf("%s:%d", dp.lg.name, dp.channel_number), snapshots)
+}
+
+// Datapools of a log group are spread over the pushers starting with nb_tsd_push,
+// returns where the next log group should start.
+func startDataPools(config *Config, lg *logGroup, tsd_pushers []chan []string, nb_tsd_push int, snapshots *snapshotRegistry, do_not_send bool) ([]*datapool, int) {
+	dps := make([]*datapool, 0)
+	for i := 0; i < lg.goroutines; i++ {
+		dp := lg.CreateDataPool(i, tsd_pushers, nb_tsd_push, config.stateDir, config.stateInterval)
+		if snapshots != nil {
+			dp.snapshots = snapshots
+			dp.last_snapshots = make(map[string]metricSnapshot)
 		}
+		if lg.statsd_passthrough {
+			dp.statsd = &statsdClient{cfg: config, do_not_send: do_not_send}
+		}
+		go dp.start()
+		dps = append(dps, dp)
+
+		nb_tsd_push = (nb_tsd_push + 1) % config.GetPusherNumber()
 	}
 
-	return dps
+	return dps, nb_tsd_push
 }
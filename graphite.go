@@ -0,0 +1,164 @@
+package logmetrics
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var graphitePlaceholder = regexp.MustCompile(`\{(\w+)\}`)
+
+// Flattens a TSD line into a dotted Graphite path. The template can reference
+// {metric}, {key_prefix}, {suffix} and any tag by name. Missing tags are skipped.
+type graphiteTemplate struct {
+	template     string
+	key_prefixes *metricPrefixes
+}
+
+func newGraphiteTemplate(config *Config, template string) *graphiteTemplate {
+	return &graphiteTemplate{template: template, key_prefixes: config.keyPrefixes}
+}
+
+func (g *graphiteTemplate) splitMetric(metric string) (string, string) {
+	if key_prefix, suffix, found := g.key_prefixes.split(metric); found {
+		return key_prefix, suffix
+	}
+
+	//Internal stats and the like
+	if pos := strings.Index(metric, "."); pos > 0 {
+		return metric[:pos], metric[pos+1:]
+	}
+
+	return metric, ""
+}
+
+func cleanGraphiteNode(value string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '.', ' ', '\t', '/':
+			return '_'
+		}
+		return r
+	}, value)
+}
+
+func (g *graphiteTemplate) path(l tsdLine) string {
+	key_prefix, suffix := g.splitMetric(l.metric)
+
+	values := map[string]string{"metric": l.metric, "key_prefix": key_prefix, "suffix": suffix}
+	for _, t := range l.tags {
+		values[t.key] = cleanGraphiteNode(t.value)
+	}
+
+	path := graphitePlaceholder.ReplaceAllStringFunc(g.template, func(placeholder string) string {
+		return values[placeholder[1:len(placeholder)-1]]
+	})
+
+	//Drop the empty nodes left by missing tags
+	nodes := strings.Split(path, ".")
+	cleanNodes := nodes[:0]
+	for _, node := range nodes {
+		if node != "" {
+			cleanNodes = append(cleanNodes, node)
+		}
+	}
+
+	return strings.Join(cleanNodes, ".")
+}
+
+func newGraphiteSink(config *Config, output *outputConfig, do_not_send bool) *connSink {
+	template := newGraphiteTemplate(config, output.graphiteTemplate)
+
+	format := func(line string) []byte {
+		l, err := parseTsdLine(line)
+		if err != nil {
+			log.Print(err)
+			return nil
+		}
+
+		return []byte(fmt.Sprintf("%s %s %d\n", template.path(l), l.value, l.timestamp))
+	}
+
+	return newBufferedConnSink(config, output, do_not_send, format)
+}
+
+// Sends a whole batch as a single pickled list of (path, (timestamp, value)) tuples
+type graphitePickleSink struct {
+	connSink
+	template *graphiteTemplate
+}
+
+func newGraphitePickleSink(config *Config, output *outputConfig, do_not_send bool) *graphitePickleSink {
+	return &graphitePickleSink{connSink: connSink{cfg: config, output: output, do_not_send: do_not_send},
+		template: newGraphiteTemplate(config, output.graphiteTemplate)}
+}
+
+// Pickle protocol 2 opcodes
+const (
+	pickleProto      = 0x80
+	pickleEmptyList  = ']'
+	pickleMark       = '('
+	pickleAppends    = 'e'
+	pickleBinUnicode = 'X'
+	pickleBinInt     = 'J'
+	pickleBinFloat   = 'G'
+	pickleTuple2     = 0x86
+	pickleStop       = '.'
+)
+
+func (s *graphitePickleSink) write(lines []string) int {
+	var buf bytes.Buffer
+	buf.Write([]byte{pickleProto, 2, pickleEmptyList, pickleMark})
+
+	nb_points := 0
+	for _, line := range lines {
+		l, err := parseTsdLine(line)
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+
+		value, _ := strconv.ParseFloat(l.value, 64)
+		path := s.template.path(l)
+
+		if s.do_not_send {
+			fmt.Printf("%s %s %d\n", path, l.value, l.timestamp)
+		}
+
+		buf.WriteByte(pickleBinUnicode)
+		binary.Write(&buf, binary.LittleEndian, uint32(len(path)))
+		buf.WriteString(path)
+
+		if l.timestamp >= math.MinInt32 && l.timestamp <= math.MaxInt32 {
+			buf.WriteByte(pickleBinInt)
+			binary.Write(&buf, binary.LittleEndian, int32(l.timestamp))
+		} else {
+			buf.WriteByte(pickleBinFloat)
+			binary.Write(&buf, binary.BigEndian, float64(l.timestamp))
+		}
+
+		buf.WriteByte(pickleBinFloat)
+		binary.Write(&buf, binary.BigEndian, value)
+
+		buf.Write([]byte{pickleTuple2, pickleTuple2})
+		nb_points++
+	}
+
+	if nb_points == 0 || s.do_not_send {
+		return buf.Len()
+	}
+
+	buf.Write([]byte{pickleAppends, pickleStop})
+
+	//Payload is prefixed by its length
+	payload := make([]byte, 4, 4+buf.Len())
+	binary.BigEndian.PutUint32(payload, uint32(buf.Len()))
+	payload = append(payload, buf.Bytes()...)
+
+	return s.send(payload)
+}
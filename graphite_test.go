@@ -0,0 +1,68 @@
+package logmetrics
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestGraphiteTemplatePath(t *testing.T) {
+	config := &Config{keyPrefixes: newMetricPrefixes([]string{"app", "web.api"})}
+
+	tests := []struct {
+		template string
+		line     string
+		expected string
+	}{
+		{"{key_prefix}.{host}.{suffix}", "app.hits.count 1 1 host=web1", "app.web1.hits.count"},
+		{"{key_prefix}.{host}.{suffix}", "web.api.latency.p99 1 1 host=web1", "web.api.web1.latency.p99"},
+		//Missing tags leave no empty node behind
+		{"{key_prefix}.{host}.{suffix}", "app.hits.count 1 1 dc=east", "app.hits.count"},
+		{"{dc}.{key_prefix}.{host}.{suffix}", "app.hits.count 1 1 host=web1", "app.web1.hits.count"},
+		{"{key_prefix}.{suffix}.{host}", "app.hits.count 1 1 dc=east", "app.hits.count"},
+		//Dots and spaces in tag values don't make extra nodes
+		{"{key_prefix}.{host}.{suffix}", "app.hits.count 1 1 host=web1.prod.mynetwork", "app.web1_prod_mynetwork.hits.count"},
+		{"{key_prefix}.{path}.{suffix}", "app.hits.count 1 1 path=/api/v1.2", "app._api_v1_2.hits.count"},
+		{"{host}.{metric}", "app.hits.count 1 1 host=web1", "web1.app.hits.count"},
+		//Not from a log group, split on the first dot
+		{"{key_prefix}.{host}.{suffix}", "logmetrics_collector.pusher.key_sent 1 1 host=web1", "logmetrics_collector.web1.pusher.key_sent"},
+	}
+
+	for _, test := range tests {
+		l, err := parseTsdLine(test.line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if path := newGraphiteTemplate(config, test.template).path(l); path != test.expected {
+			t.Errorf("%s with %q: expected %s, got %s", test.template, test.line, test.expected, path)
+		}
+	}
+}
+
+func TestGraphitePickleBytes(t *testing.T) {
+	config := newTestConfig()
+	config.keyPrefixes = newMetricPrefixes([]string{"app"})
+	s := newGraphitePickleSink(config, &outputConfig{pushHosts: []string{"127.0.0.1:2004"}, pushProto: "tcp",
+		graphiteTemplate: "{key_prefix}.{host}.{suffix}"}, false)
+
+	conn := &partialConn{limit: 1 << 20}
+	s.conn = conn
+
+	s.write([]string{"app.hits.count 1500000000 3 host=x", "app.hits.p99 1500000001 1.5"})
+
+	expected := []byte{
+		0x00, 0x00, 0x00, 0x4c, //Length of what follows
+		0x80, 0x02, ']', '(',
+		'X', 0x10, 0x00, 0x00, 0x00, 'a', 'p', 'p', '.', 'x', '.', 'h', 'i', 't', 's', '.', 'c', 'o', 'u', 'n', 't',
+		'J', 0x00, 0x2f, 0x68, 0x59,
+		'G', 0x40, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x86, 0x86,
+		'X', 0x0c, 0x00, 0x00, 0x00, 'a', 'p', 'p', '.', 'h', 'i', 't', 's', '.', 'p', '9', '9',
+		'J', 0x01, 0x2f, 0x68, 0x59,
+		'G', 0x3f, 0xf8, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x86, 0x86,
+		'e', '.',
+	}
+	if !bytes.Equal(conn.written.Bytes(), expected) {
+		t.Errorf("expected\n% x\ngot\n% x", expected, conn.written.Bytes())
+	}
+}
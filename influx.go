@@ -0,0 +1,195 @@
+package logmetrics
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+var influxEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+var influxMeasurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+
+type influxPoint struct {
+	measurement string
+	tags        string
+	timestamp   int64
+	fields      []string
+}
+
+func (ip *influxPoint) String() string {
+	return fmt.Sprintf("%s%s %s %d", ip.measurement, ip.tags, strings.Join(ip.fields, ","), ip.timestamp*int64(time.Second))
+}
+
+// Renders TSD lines as InfluxDB line protocol. Every stat of a key, like all
+// the percentiles of a histogram, becomes a field of a single point.
+type influxSink struct {
+	connSink
+	bases *metricPrefixes
+
+	//Over http, datagrams go through connSink
+	targets requestTargets
+	client  *http.Client
+}
+
+func newInfluxSink(config *Config, output *outputConfig, do_not_send bool) *influxSink {
+	s := influxSink{connSink: connSink{cfg: config, output: output, do_not_send: do_not_send},
+		bases: config.keyBases}
+
+	if output.pushProto == "http" {
+		s.targets = requestTargets{cfg: config, output: output}
+		s.client = &http.Client{Timeout: time.Duration(config.pushTimeout) * time.Second}
+	}
+
+	return &s
+}
+
+func (s *influxSink) getUrl(target string) string {
+	params := url.Values{}
+	params.Set("db", s.output.influxDb)
+	return fmt.Sprintf("http://%s/write?%s", target, params.Encode())
+}
+
+func (s *influxSink) getBackoffs() []*backoff {
+	if s.client != nil {
+		return []*backoff{&s.targets.backoff}
+	}
+	return s.connSink.getBackoffs()
+}
+
+// Measurement is key_prefix.key_suffix, the field what the metric appends to it
+func (s *influxSink) splitMetric(metric string) (string, string) {
+	if base, field, found := s.bases.split(metric); found {
+		return base, field
+	}
+
+	//Internal stats and the like
+	if pos := strings.LastIndex(metric, "."); pos > 0 {
+		return metric[:pos], metric[pos+1:]
+	}
+
+	return metric, "value"
+}
+
+func (s *influxSink) encode(lines []string) []string {
+	points := make([]*influxPoint, 0)
+	index := make(map[string]*influxPoint)
+
+	for _, line := range lines {
+		l, err := parseTsdLine(line)
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+
+		measurement, field := s.splitMetric(l.metric)
+
+		sortedTags := make([]string, 0, len(l.tags))
+		for _, t := range l.tags {
+			if t.value != "" {
+				sortedTags = append(sortedTags, influxEscaper.Replace(t.key)+"="+influxEscaper.Replace(t.value))
+			}
+		}
+		sort.Strings(sortedTags)
+
+		var tags string
+		if len(sortedTags) > 0 {
+			tags = "," + strings.Join(sortedTags, ",")
+		}
+
+		//Group stats of the same series and time in one point
+		id := fmt.Sprintf("%s%s %d", measurement, tags, l.timestamp)
+		point, ok := index[id]
+		if !ok {
+			point = &influxPoint{measurement: influxMeasurementEscaper.Replace(measurement), tags: tags, timestamp: l.timestamp}
+			index[id] = point
+			points = append(points, point)
+		}
+		point.fields = append(point.fields, influxEscaper.Replace(field)+"="+l.value)
+	}
+
+	encoded := make([]string, len(points))
+	for i, point := range points {
+		encoded[i] = point.String()
+	}
+
+	return encoded
+}
+
+func (s *influxSink) write(lines []string) int {
+	encoded := s.encode(lines)
+
+	byte_written := 0
+	if s.do_not_send {
+		for _, line := range encoded {
+			fmt.Println(line)
+			byte_written += len(line) + 1
+		}
+		return byte_written
+	}
+
+	if s.client != nil {
+		for start := 0; start < len(encoded); start += s.cfg.pushBatchSize {
+			end := start + s.cfg.pushBatchSize
+			if end > len(encoded) {
+				end = len(encoded)
+			}
+
+			body := strings.Join(encoded[start:end], "\n") + "\n"
+			s.post([]byte(body))
+			byte_written += len(body)
+		}
+
+		return byte_written
+	}
+
+	//Pack as many lines as possible per datagram
+	var buf bytes.Buffer
+	for _, line := range encoded {
+		if buf.Len() > 0 && buf.Len()+len(line)+1 > maxDatagramPayload {
+			byte_written += s.send(buf.Bytes())
+			buf.Reset()
+		}
+		buf.WriteString(line + "\n")
+	}
+	if buf.Len() > 0 {
+		byte_written += s.send(buf.Bytes())
+	}
+
+	return byte_written
+}
+
+// Blocks until the batch is accepted. Batches rejected as invalid are dropped.
+func (s *influxSink) post(body []byte) {
+	for {
+		if s.targets.backoff.failFast(bytes.Count(body, []byte("\n"))) {
+			return
+		}
+		url := s.getUrl(s.targets.get())
+		resp, err := s.client.Post(url, "text/plain", bytes.NewReader(body))
+		if err != nil {
+			s.targets.failed(fmt.Sprintf("Error posting data to %s: %s", url, err))
+			continue
+		}
+
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		switch {
+		case resp.StatusCode < 300:
+			s.targets.succeeded()
+			return
+		case resp.StatusCode < 500:
+			s.targets.succeeded()
+			log.Printf("Dropping batch rejected by InfluxDB, %s: %s", resp.Status, respBody)
+			return
+		default:
+			s.targets.failed(fmt.Sprintf("InfluxDB at %s returned %s: %s", url, resp.Status, respBody))
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package logmetrics
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestInfluxEncode(t *testing.T) {
+	config := &Config{keyBases: newMetricPrefixes([]string{"app.latency", "app,eu.hits"})}
+	s := newInfluxSink(config, &outputConfig{pushProto: "udp", pushType: "influx"}, true)
+
+	tests := []struct {
+		name     string
+		lines    []string
+		expected []string
+	}{
+		{"stats of a series in one point",
+			[]string{"app.latency.p50 10 5 host=web1", "app.latency.p99 10 9 host=web1", "app.latency.rate._1min 10 0.5 host=web1"},
+			[]string{"app.latency,host=web1 p50=5,p99=9,rate._1min=0.5 10000000000"}},
+		{"one point per series and time",
+			[]string{"app.latency.p50 10 5 host=web1", "app.latency.p50 10 6 host=web2", "app.latency.p99 11 9 host=web1", "app.latency.p99 10 7 host=web2"},
+			[]string{"app.latency,host=web1 p50=5 10000000000", "app.latency,host=web2 p50=6,p99=7 10000000000", "app.latency,host=web1 p99=9 11000000000"}},
+		{"sorted tags, empty ones dropped",
+			[]string{"app.latency.p50 10 5 path=/a host=web1 dc="},
+			[]string{"app.latency,host=web1,path=/a p50=5 10000000000"}},
+		{"tag keys and values escaped",
+			[]string{"app.latency.p50 10 5 path=/a,b=c"},
+			[]string{`app.latency,path=/a\,b\=c p50=5 10000000000`}},
+		{"measurement escaped",
+			[]string{"app,eu.hits.count 10 3"},
+			[]string{`app\,eu.hits count=3 10000000000`}},
+		{"field escaped",
+			[]string{"logmetrics_collector.a,b=c 10 3"},
+			[]string{`logmetrics_collector a\,b\=c=3 10000000000`}},
+		{"no key base",
+			[]string{"uptime 10 3 host=web1"},
+			[]string{"uptime,host=web1 value=3 10000000000"}},
+	}
+
+	for _, test := range tests {
+		if encoded := s.encode(test.lines); !reflect.DeepEqual(encoded, test.expected) {
+			t.Errorf("%s: expected %q, got %q", test.name, test.expected, encoded)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package logmetrics
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Fields of json log lines, by path: request.duration_ms, items.0.id. A leading $,
+// required in tags to tell them from values, is optional elsewhere.
+// Fields are numbered as tags, date and metrics use them, like a regex's groups,
+// and are followed by the filename_match groups.
+type jsonFields struct {
+	paths     [][]string
+	positions map[string]int
+	//Set once the mapping is parsed, filename_match groups come right after
+	frozen bool
+}
+
+func newJsonFields() *jsonFields {
+	return &jsonFields{positions: make(map[string]int)}
+}
+
+func (f *jsonFields) position(group string, path string, field string) int {
+	field = strings.TrimPrefix(field, "$")
+	if pos, found := f.positions[field]; found {
+		return pos
+	}
+
+	if f.frozen {
+		configFail(group, path, "field %s isn't used by tags, date or metrics", field)
+	}
+	if field == "" || strings.HasPrefix(field, ".") || strings.HasSuffix(field, ".") || strings.Contains(field, "..") {
+		configFail(group, path, "invalid field path %q", field)
+	}
+
+	f.paths = append(f.paths, strings.Split(field, "."))
+	f.positions[field] = len(f.paths)
+
+	return len(f.paths)
+}
+
+// Same layout as a regex match: the line, its fields then the filename_match groups.
+// Lines have to be a single json object. Missing fields are empty,
+// objects and arrays are left as json.
+func (f *jsonFields) parse(line string, filename_matches []string) ([]string, error) {
+	var doc map[string]interface{}
+	decoder := json.NewDecoder(strings.NewReader(line))
+	decoder.UseNumber()
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, err
+	}
+	if doc == nil {
+		return nil, fmt.Errorf("not a json object")
+	}
+	if decoder.More() {
+		return nil, fmt.Errorf("unexpected data after the json object")
+	}
+
+	matches := make([]string, 1, len(f.paths)+len(filename_matches)+1)
+	matches[0] = line
+	for _, path := range f.paths {
+		matches = append(matches, jsonString(jsonLookup(doc, path)))
+	}
+
+	return append(matches, filename_matches...), nil
+}
+
+func jsonLookup(doc interface{}, path []string) interface{} {
+	for _, key := range path {
+		switch v := doc.(type) {
+		case map[string]interface{}:
+			doc = v[key]
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil
+			}
+			doc = v[i]
+		default:
+			return nil
+		}
+	}
+
+	return doc
+}
+
+func jsonString(val interface{}) string {
+	switch v := val.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	}
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(val); err != nil {
+		return fmt.Sprint(val)
+	}
+
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+// Tags, date and metrics of a json log group. A first pass finds the fields used,
+// the second one puts the filename_match groups after them.
+func (lg *logGroup) parseJsonMapping(conf *logGroupConfig) {
+	m := &lg.lineMapping
+	m.fields = newJsonFields()
+
+	lg.parseMapping(m, nil, 0, conf.Tags, &conf.Date, conf.Metrics)
+	lg.parseMapping(m, nil, len(m.fields.paths), conf.Tags, &conf.Date, conf.Metrics)
+	m.fields.frozen = true
+
+	lg.mappings = []*lineMapping{m}
+}
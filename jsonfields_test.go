@@ -0,0 +1,41 @@
+package logmetrics
+
+import (
+	"testing"
+)
+
+func TestJsonTagsKeepLiterals(t *testing.T) {
+	conf := &logGroupConfig{Format: "json", RegexEngine: "re2", Goroutines: 1, KeyPrefix: "app",
+		Date: dateConfig{Position: "time", Format: "2006-01-02T15:04:05Z07:00"},
+		Tags: map[string]interface{}{"call": "$request.path", "env": "prod"},
+		Metrics: map[string][]*metricConfig{
+			"histogram": {{KeySuffix: "latency", Format: "int", Multiply: 1, Divide: 1, Reference: [][]interface{}{{"$request.duration_ms", "resource=total"}}}},
+		},
+	}
+	lg := newLogGroup("app", conf)
+
+	if env := lg.tags["env"]; env != "prod" {
+		t.Errorf("expected env to stay the literal prod, got %#v", env)
+	}
+
+	matches, err := lg.fields.parse(`{"time": "2016-01-02T03:04:05Z", "request": {"path": "/users", "duration_ms": 12}}`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	call, ok := lg.tags["call"].(int)
+	if !ok || matches[call] != "/users" {
+		t.Errorf("expected call to be the request.path field, got %#v", lg.tags["call"])
+	}
+	if matches[lg.date_position] != "2016-01-02T03:04:05Z" {
+		t.Errorf("expected the date field without a $, got %q", matches[lg.date_position])
+	}
+	if len(lg.metrics) != 1 {
+		t.Fatalf("expected a single metric reference, got %v", lg.metrics)
+	}
+	for position := range lg.metrics {
+		if matches[position] != "12" {
+			t.Errorf("expected the $request.duration_ms field for the metric, got %q", matches[position])
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package logmetrics
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// Produces each line as a message keyed by its series, metric name and tags, so the
+// hash partitioner keeps every series on one partition and in order.
+type kafkaSink struct {
+	cfg         *Config
+	output      *outputConfig
+	do_not_send bool
+	brokers     []string
+
+	newProducer func([]string, *sarama.Config) (sarama.SyncProducer, error)
+	producer    sarama.SyncProducer
+	backoff     backoff
+}
+
+func newKafkaSink(config *Config, output *outputConfig, do_not_send bool) *kafkaSink {
+	s := kafkaSink{cfg: config, output: output, do_not_send: do_not_send, newProducer: sarama.NewSyncProducer}
+
+	//push_host can be a comma separated list of brokers
+	for _, host := range strings.Split(output.pushHost, ",") {
+		s.brokers = append(s.brokers, fmt.Sprintf("%s:%d", strings.TrimSpace(host), output.pushPort))
+	}
+
+	return &s
+}
+
+func (s *kafkaSink) String() string {
+	return fmt.Sprintf("kafka topic %s on %s", s.output.kafkaTopic, strings.Join(s.brokers, ","))
+}
+
+func (s *kafkaSink) getBackoffs() []*backoff {
+	return []*backoff{&s.backoff}
+}
+
+func (s *kafkaSink) getProducerConfig() *sarama.Config {
+	kcfg := sarama.NewConfig()
+	kcfg.ClientID = "logmetrics_collector"
+	kcfg.Producer.RequiredAcks = sarama.WaitForAll
+	kcfg.Producer.Partitioner = sarama.NewHashPartitioner
+	kcfg.Producer.Return.Successes = true
+	kcfg.Producer.Retry.Max = s.cfg.pushRetries
+
+	//A single request in flight per broker so retries can't reorder messages
+	kcfg.Net.MaxOpenRequests = 1
+	kcfg.Net.DialTimeout = time.Duration(s.cfg.pushTimeout) * time.Second
+	kcfg.Net.WriteTimeout = time.Duration(s.cfg.pushTimeout) * time.Second
+	kcfg.Net.ReadTimeout = time.Duration(s.cfg.pushTimeout) * time.Second
+
+	return kcfg
+}
+
+func getSeriesKey(l tsdLine) string {
+	tags := make([]string, len(l.tags))
+	for i, t := range l.tags {
+		tags[i] = t.key + "=" + t.value
+	}
+	sort.Strings(tags)
+
+	return l.metric + " " + strings.Join(tags, " ")
+}
+
+func (s *kafkaSink) write(lines []string) int {
+	byte_written := 0
+	messages := make([]*sarama.ProducerMessage, 0, len(lines))
+	for _, line := range lines {
+		l, err := parseTsdLine(line)
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+
+		if s.do_not_send {
+			fmt.Printf("%s: %s\n", s.output.kafkaTopic, line)
+		}
+
+		messages = append(messages, &sarama.ProducerMessage{Topic: s.output.kafkaTopic,
+			Key: sarama.StringEncoder(getSeriesKey(l)), Value: sarama.StringEncoder(line)})
+		byte_written += len(line)
+	}
+
+	if s.do_not_send {
+		return byte_written
+	}
+
+	//Block until everything made it, like the other outputs
+	for len(messages) > 0 {
+		if s.backoff.failFast(len(messages)) {
+			break
+		}
+		if s.producer == nil {
+			var err error
+			if s.backoff.isClosed() {
+				log.Printf("Connecting to Kafka brokers %s", strings.Join(s.brokers, ","))
+			}
+			if s.producer, err = s.newProducer(s.brokers, s.getProducerConfig()); err != nil {
+				s.producer = nil
+				s.backoff.failed(s.cfg, fmt.Sprintf("Unable to connect to Kafka: %s", err))
+				continue
+			}
+		}
+
+		err := s.producer.SendMessages(messages)
+		if err == nil {
+			s.backoff.succeeded()
+			break
+		}
+
+		//Resend from the first one that failed on, what came after it may be of the
+		//same series and can't go through before it
+		if producerErrors, ok := err.(sarama.ProducerErrors); ok {
+			failed := make(map[*sarama.ProducerMessage]bool, len(producerErrors))
+			for _, producerError := range producerErrors {
+				failed[producerError.Msg] = true
+			}
+			s.backoff.failed(s.cfg, fmt.Sprintf("Unable to produce %d of %d messages to Kafka: %s", len(failed), len(messages), producerErrors[0].Err))
+
+			for i, message := range messages {
+				if failed[message] {
+					messages = messages[i:]
+					break
+				}
+			}
+		} else {
+			s.close()
+			s.backoff.failed(s.cfg, fmt.Sprintf("Error producing to Kafka: %s", err))
+		}
+	}
+
+	return byte_written
+}
+
+func (s *kafkaSink) flush() {
+}
+
+func (s *kafkaSink) close() {
+	if s.producer != nil {
+		s.producer.Close()
+		s.producer = nil
+	}
+}
@@ -0,0 +1,190 @@
+package logmetrics
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// Stands in for the brokers. Methods it doesn't implement panic.
+type mockProducer struct {
+	sarama.SyncProducer
+
+	mu       sync.Mutex
+	messages []*sarama.ProducerMessage
+}
+
+func (p *mockProducer) SendMessages(messages []*sarama.ProducerMessage) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.messages = append(p.messages, messages...)
+	return nil
+}
+
+func (p *mockProducer) Close() error {
+	return nil
+}
+
+func newTestKafkaSink() *kafkaSink {
+	config := &Config{pushWait: 1, pushMaxWait: 1, pushBackoffFactor: 2, pushBreakerThreshold: 5, pushRetries: 3, pushTimeout: 1}
+	return newKafkaSink(config, &outputConfig{pushHost: "broker1, broker2", pushPort: 9092, kafkaTopic: "metrics", pushType: "kafka"}, false)
+}
+
+func encoded(t *testing.T, e sarama.Encoder) string {
+	b, err := e.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestKafkaKeysBySeries(t *testing.T) {
+	producer := &mockProducer{}
+	s := newTestKafkaSink()
+	s.newProducer = func(brokers []string, kcfg *sarama.Config) (sarama.SyncProducer, error) {
+		if len(brokers) != 2 || brokers[0] != "broker1:9092" || brokers[1] != "broker2:9092" {
+			t.Errorf("unexpected brokers %v", brokers)
+		}
+		return producer, nil
+	}
+
+	lines := []string{
+		"app.hits.count 1 10 host=a call=x",
+		"app.hits.count 2 11 call=x host=a",
+		"app.hits.count 2 12 call=y host=a",
+	}
+	s.write(lines)
+
+	if len(producer.messages) != 3 {
+		t.Fatalf("expected 3 messages, got %d", len(producer.messages))
+	}
+	keys := make([]string, 3)
+	for i, message := range producer.messages {
+		if message.Topic != "metrics" {
+			t.Errorf("message sent to %s", message.Topic)
+		}
+		if value := encoded(t, message.Value); value != lines[i] {
+			t.Errorf("message %d is %q, expected the line as is", i, value)
+		}
+		keys[i] = encoded(t, message.Key)
+	}
+
+	if keys[0] != "app.hits.count call=x host=a" || keys[1] != keys[0] {
+		t.Errorf("expected the same series to have the same key whatever the tag order, got %q and %q", keys[0], keys[1])
+	}
+	if keys[2] == keys[0] {
+		t.Errorf("expected another series to get another key, got %q", keys[2])
+	}
+}
+
+func TestKafkaBlocksWhileBrokersAreDown(t *testing.T) {
+	producer := &mockProducer{}
+
+	var mu sync.Mutex
+	available, attempts := false, 0
+
+	s := newTestKafkaSink()
+	s.newProducer = func(brokers []string, kcfg *sarama.Config) (sarama.SyncProducer, error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		attempts++
+		if !available {
+			return nil, errors.New("kafka: client has run out of available brokers")
+		}
+		return producer, nil
+	}
+
+	done := make(chan bool)
+	go func() {
+		s.write([]string{"app.hits.count 1 10 host=a"})
+		close(done)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		tried := attempts
+		mu.Unlock()
+		if tried >= 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the sink to keep trying to connect")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	select {
+	case <-done:
+		t.Fatal("write returned while no broker was available")
+	default:
+	}
+
+	mu.Lock()
+	available = true
+	mu.Unlock()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("write still blocked once the brokers came back")
+	}
+
+	if len(producer.messages) != 1 {
+		t.Fatalf("expected the message to be produced once the brokers came back, got %d", len(producer.messages))
+	}
+	if b := s.getBackoffs()[0]; b.blocked == 0 || !b.isClosed() || b.failures != 0 {
+		t.Errorf("expected the wait to be reported and the backoff reset, got %+v", *b)
+	}
+}
+
+// Fails the messages at fail_at on the first call, like a partition leader going away
+type failingProducer struct {
+	mockProducer
+	fail_at []int
+	calls   [][]*sarama.ProducerMessage
+}
+
+func (p *failingProducer) SendMessages(messages []*sarama.ProducerMessage) error {
+	p.calls = append(p.calls, messages)
+	if len(p.calls) > 1 {
+		return p.mockProducer.SendMessages(messages)
+	}
+
+	var producerErrors sarama.ProducerErrors
+	for _, i := range p.fail_at {
+		producerErrors = append(producerErrors, &sarama.ProducerError{Msg: messages[i], Err: sarama.ErrNotLeaderForPartition})
+	}
+	return producerErrors
+}
+
+func TestKafkaResendsFromFirstFailure(t *testing.T) {
+	producer := &failingProducer{fail_at: []int{3, 1}}
+	s := newTestKafkaSink()
+	s.newProducer = func(brokers []string, kcfg *sarama.Config) (sarama.SyncProducer, error) {
+		return producer, nil
+	}
+
+	lines := []string{
+		"app.hits.count 1 10 host=a",
+		"app.hits.count 1 11 host=b",
+		"app.hits.count 2 12 host=a",
+		"app.hits.count 2 13 host=b",
+	}
+	s.write(lines)
+
+	//host=a at 2 went through but is sent again, nothing gets ahead of a failed message
+	if len(producer.calls) != 2 || len(producer.calls[1]) != 3 {
+		t.Fatalf("expected a single resend of the last 3 messages, got %d calls", len(producer.calls))
+	}
+	for i, message := range producer.calls[1] {
+		if value := encoded(t, message.Value); value != lines[i+1] {
+			t.Errorf("resent message %d is %q, expected %q", i, value, lines[i+1])
+		}
+	}
+}
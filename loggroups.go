@@ -0,0 +1,104 @@
+package logmetrics
+
+import (
+	"log"
+)
+
+// Everything running for a single log group
+type logGroupRunner struct {
+	lg        *logGroup
+	poller    *filenamePoller
+	datapools []*datapool
+}
+
+// Tailers and datapools of every log group. Groups can be started and stopped
+// individually so a config reload only touches the ones that changed.
+type LogGroups struct {
+	cfg         *Config
+	tsd_pushers []chan []string
+	offsets     *tailOffsets
+	snapshots   *snapshotRegistry
+	do_not_send bool
+
+	runners     map[string]*logGroupRunner
+	nb_tsd_push int
+}
+
+func StartLogGroups(config *Config, tsd_pushers []chan []string, offsets *tailOffsets, snapshots *snapshotRegistry, do_not_send bool) *LogGroups {
+	if offsets != nil {
+		go offsets.start()
+	}
+
+	lgs := LogGroups{cfg: config, tsd_pushers: tsd_pushers, offsets: offsets, snapshots: snapshots, do_not_send: do_not_send,
+		runners: make(map[string]*logGroupRunner)}
+
+	for name, lg := range config.logGroups {
+		lgs.runners[name] = lgs.start(lg)
+	}
+
+	return &lgs
+}
+
+func (lgs *LogGroups) start(lg *logGroup) *logGroupRunner {
+	r := logGroupRunner{lg: lg}
+
+	//Datapools first, tailers block until they're there
+	r.datapools, lgs.nb_tsd_push = startDataPools(lgs.cfg, lg, lgs.tsd_pushers, lgs.nb_tsd_push, lgs.snapshots, lgs.do_not_send)
+	r.poller = startTails(lgs.cfg, lg, lgs.tsd_pushers, lgs.offsets)
+
+	return &r
+}
+
+func (r *logGroupRunner) stop() {
+	r.poller.Stop()
+	for _, dp := range r.datapools {
+		dp.Stop()
+	}
+}
+
+// Applies the log groups of a freshly loaded config. Unchanged groups keep running
+// untouched, changed ones are restarted. Settings are only read at startup.
+func (lgs *LogGroups) Reload(config *Config) {
+	if config.raw_settings != lgs.cfg.raw_settings {
+		log.Print("Changes to settings are ignored until restart")
+	}
+
+	//Outputs were built with the startup config, they see the new keys through it
+	lgs.cfg.keyPrefixes.set(getKeyPrefixes(config.logGroups))
+	lgs.cfg.keyBases.set(getKeyBases(config.logGroups))
+
+	for name, r := range lgs.runners {
+		lg, found := config.logGroups[name]
+		if !found {
+			log.Printf("Log group %s removed, stopping it", name)
+			r.stop()
+			delete(lgs.runners, name)
+		} else if lg.raw_config != r.lg.raw_config {
+			log.Printf("Log group %s changed, restarting it", name)
+			r.stop()
+			lgs.runners[name] = lgs.start(lg)
+		}
+	}
+
+	for name, lg := range config.logGroups {
+		if _, found := lgs.runners[name]; !found {
+			log.Printf("Log group %s added, starting it", name)
+			lgs.runners[name] = lgs.start(lg)
+		}
+	}
+}
+
+// Stops every tailer, datapools keep going until StopDataPools
+func (lgs *LogGroups) StopTails() {
+	for _, r := range lgs.runners {
+		r.poller.Stop()
+	}
+}
+
+func (lgs *LogGroups) StopDataPools() {
+	for _, r := range lgs.runners {
+		for _, dp := range r.datapools {
+			dp.Stop()
+		}
+	}
+}
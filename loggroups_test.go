@@ -0,0 +1,29 @@
+package logmetrics
+
+import (
+	"testing"
+)
+
+func TestReloadUpdatesMetricPrefixes(t *testing.T) {
+	config := &Config{keyPrefixes: newMetricPrefixes([]string{"app"}), keyBases: newMetricPrefixes([]string{"app.hits"})}
+	template := newGraphiteTemplate(config, "{key_prefix}.{host}.{suffix}")
+	influx := newInfluxSink(config, &outputConfig{pushProto: "udp", pushType: "influx"}, true)
+
+	line := tsdLine{metric: "web.api.latency.p99", tags: []tag{{key: "host", value: "x"}}}
+	if path := template.path(line); path != "web.x.api.latency.p99" {
+		t.Fatalf("unexpected path %s before the reload", path)
+	}
+
+	//Unchanged as far as Reload can tell, so nothing is restarted
+	lg := &logGroup{name: "web", key_prefix: "web.api",
+		mappings: []*lineMapping{{metrics: map[int][]keyExtract{1: {{key_suffix: "latency"}}}}}}
+	lgs := &LogGroups{cfg: config, runners: map[string]*logGroupRunner{"web": {lg: lg}}}
+	lgs.Reload(&Config{logGroups: map[string]*logGroup{"web": lg}})
+
+	if path := template.path(line); path != "web.api.x.latency.p99" {
+		t.Errorf("expected the reloaded key_prefix to be used, got %s", path)
+	}
+	if measurement, field := influx.splitMetric(line.metric); measurement != "web.api.latency" || field != "p99" {
+		t.Errorf("expected the reloaded key base to be used, got %s and %s", measurement, field)
+	}
+}
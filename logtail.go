@@ -14,10 +14,15 @@ type tailer struct {
 	filename       string
 	channel_number int
 	tsd_pusher     chan []string
+	offsets        *tailOffsets
+	//File being read and how far its lines were handled, saved to offsets
+	position fileOffset
+	tracking bool
 
 	lg *logGroup
 
-	Bye chan bool
+	Bye  chan bool
+	done chan bool
 }
 
 type tailStats struct {
@@ -34,6 +39,8 @@ type tailStats struct {
 type lineResult struct {
 	filename string
 	matches  []string
+	//Index of the regex that matched, for its mapping
+	re_index int
 }
 
 func (ts *tailStats) isTimeForStats() bool {
@@ -64,24 +71,37 @@ func (ts *tailStats) getTailStatsKey() []string {
 }
 
 func (t *tailer) tailFile() {
+	defer close(t.done)
+
 	t.ts = tailStats{last_report: time.Now(), hostname: getHostname(),
 		filename: t.filename, log_group: t.lg.name, interval: t.lg.interval}
 
-	maxMatches := t.lg.expected_matches + 1
-
 	var filename_matches []string
 	if t.lg.filename_match_re != nil {
-		m := t.lg.filename_match_re.MatcherString(t.filename, 0)
-		filename_matches = m.ExtractString()[1:]
+		filename_matches = t.lg.filename_match_re.findSubmatch(t.filename)[1:]
 	}
 
-	//os.Seek end of file descriptor
-	seekParam := 2
-	if t.lg.parse_from_start {
-		seekParam = 0
-	}
+	//Lines are counted from where tail starts so saved offsets only cover handled lines
+	var loc tail.SeekInfo
+	current, size, err := getFileOffset(t.filename)
+	if err == nil {
+		t.position, t.tracking = current, true
+		if !t.lg.parse_from_start {
+			t.position.Offset = size
+		}
 
-	loc := tail.SeekInfo{0, seekParam}
+		//Resume from the last saved offset if it's still the same file
+		if t.offsets != nil {
+			if saved, ok := t.offsets.get(t.filename); ok && current.sameFile(saved) && saved.Offset <= size {
+				log.Printf("Resuming %s at offset %d", t.filename, saved.Offset)
+				t.position.Offset = saved.Offset
+			}
+		}
+		loc.Offset = t.position.Offset
+	} else if !t.lg.parse_from_start {
+		//os.Seek end of file descriptor
+		loc.Whence = 2
+	}
 
 	maxLineSize := 2048
 
@@ -91,6 +111,11 @@ func (t *tailer) tailFile() {
 		log.Fatalf("Unable to tail %s: %s", t.filename, err)
 		return
 	}
+	//Releases its goroutines and inotify watches, on restarts too
+	defer func() {
+		tail.Stop()
+		tail.Cleanup()
+	}()
 	log.Printf("Tailing %s data to datapool[%s:%d]", t.filename, t.lg.name, t.channel_number)
 
 	line_overflow := false
@@ -113,26 +138,45 @@ func (t *tailer) tailFile() {
 				continue
 			}
 
+			//Long lines come in maxLineSize chunks, only the last one had a newline
+			line_size := int64(len(line.Text))
+			if len(line.Text) != maxLineSize {
+				line_size++
+			}
+
 			//Support to skip very long lines
 			if line_overflow {
 				line_overflow = (len(line.Text) == maxLineSize)
+				t.position.Offset += line_size
 				continue
 			}
 
 			line_overflow = (len(line.Text) == maxLineSize)
 
-			//Test out all the regexp, pick the first one that matches
 			match_one := false
-			for _, re := range t.lg.re {
-				m := re.MatcherString(line.Text, 0)
-				matches := m.ExtractString()
-				if len(matches) == maxMatches {
+			//Json log groups have no regexes, lines that fail to decode aren't matched
+			if t.lg.fields != nil {
+				matches, err := t.lg.fields.parse(line.Text, filename_matches)
+				if err == nil {
 					match_one = true
+					t.lg.tail_data[t.channel_number] <- lineResult{filename: t.filename, matches: matches}
+					t.ts.incLineMatch()
+				} else if t.lg.fail_regex_warn {
+					log.Printf("Json decode failed on %s: %s: %s", t.filename, err, line.Text)
+				}
+			}
+
+			//Test out all the regexp, pick the first one that matches
+			for i, re := range t.lg.re {
+				matches := re.findSubmatch(line.Text)
+				if len(matches) == t.lg.mappings[i].expected_matches+1 {
+					match_one = true
+					matches = t.lg.orderMatches(i, matches)
 					if filename_matches != nil {
 						matches = append(matches, filename_matches[:]...)
 					}
 
-					results := lineResult{t.filename, matches}
+					results := lineResult{filename: t.filename, matches: matches, re_index: i}
 					t.lg.tail_data[t.channel_number] <- results
 					t.ts.incLineMatch()
 					break
@@ -140,40 +184,82 @@ func (t *tailer) tailFile() {
 			}
 
 			t.ts.incLine(line.Text)
+			t.position.Offset += line_size
 
-			if t.lg.fail_regex_warn && !match_one {
-				log.Printf("Regexp match failed on %s, expected %d matches: %s", t.filename, maxMatches, line.Text)
+			if t.lg.fail_regex_warn && !match_one && t.lg.fields == nil {
+				log.Printf("Regexp match failed on %s: %s", t.filename, line.Text)
 			}
 
-			if (t.ts.line_read%100) == 0 && t.ts.isTimeForStats() {
-				t.tsd_pusher <- t.ts.getTailStatsKey()
+			if (t.ts.line_read % 100) == 0 {
+				t.saveOffset()
+
+				if t.ts.isTimeForStats() {
+					t.tsd_pusher <- t.ts.getTailStatsKey()
+				}
 			}
 		case <-t.Bye:
+			t.saveOffset()
 			log.Printf("Tailer for %s stopped.", t.filename)
 			return
 		}
 	}
 }
 
+func (t *tailer) saveOffset() {
+	if t.offsets == nil || !t.tracking {
+		return
+	}
+
+	//Once rotated or truncated tail reopens the file, lines can't be told apart anymore
+	current, size, err := getFileOffset(t.filename)
+	if err != nil || !current.sameFile(t.position) || size < t.position.Offset {
+		t.tracking = false
+		return
+	}
+
+	t.offsets.set(t.filename, t.position)
+}
+
 type filenamePoller struct {
 	lg            *logGroup
 	poll_interval int
 	tsd_pushers   []chan []string
 	push_number   int
+	offsets       *tailOffsets
+
+	Bye  chan bool
+	done chan bool
+}
 
-	Bye chan bool
+// Returns once every tailer of the log group stopped
+func (fp *filenamePoller) Stop() {
+	fp.Bye <- true
+	<-fp.done
 }
 
 func (fp *filenamePoller) startFilenamePoller() {
+	defer close(fp.done)
+
 	log.Printf("Filename poller for %s started", fp.lg.name)
 	log.Printf("Using the following regexp for log group %s: %s", fp.lg.name, fp.lg.strRegexp)
 
 	rescanFiles := make(chan bool, 1)
+	stopRescan := make(chan bool)
+	defer close(stopRescan)
 	go func() {
 		rescanFiles <- true
 		for {
-			time.Sleep(time.Duration(fp.poll_interval) * time.Second)
-			rescanFiles <- true
+			select {
+			case <-time.After(time.Duration(fp.poll_interval) * time.Second):
+			case <-stopRescan:
+				return
+			}
+
+			select {
+			case rescanFiles <- true:
+			case <-stopRescan:
+				return
+			}
 		}
 	}()
 
@@ -208,8 +294,8 @@ func (fp *filenamePoller) startFilenamePoller() {
 			//Start tailing new files!
 			for file, _ := range newFiles {
 				bye := make(chan bool)
-				t := tailer{filename: file, channel_number: channel_number, lg: fp.lg, Bye: bye,
-					tsd_pusher: fp.tsd_pushers[pusher_channel_number]}
+				t := tailer{filename: file, channel_number: channel_number, lg: fp.lg, Bye: bye, done: make(chan bool),
+					tsd_pusher: fp.tsd_pushers[pusher_channel_number], offsets: fp.offsets}
 				go t.tailFile()
 				allTailers = append(allTailers, &t)
 
@@ -219,8 +305,13 @@ func (fp *filenamePoller) startFilenamePoller() {
 				currentFiles[file] = true
 			}
 		case <-fp.Bye:
+			//Tailers that already ended on their own are skipped
 			for _, t := range allTailers {
-				go func() { t.Bye <- true }()
+				select {
+				case t.Bye <- true:
+				case <-t.done:
+				}
+				<-t.done
 			}
 			log.Printf("Filename poller for %s stopped", fp.lg.name)
 			return
@@ -228,14 +319,10 @@ func (fp *filenamePoller) startFilenamePoller() {
 	}
 }
 
-func StartTails(config *Config, tsd_pushers []chan []string) []*filenamePoller {
-	filenamePollers := make([]*filenamePoller, 0)
-	for _, logGroup := range config.logGroups {
-		bye := make(chan bool)
-		f := filenamePoller{lg: logGroup, poll_interval: config.pollInterval, tsd_pushers: tsd_pushers, push_number: config.GetPusherNumber(), Bye: bye}
-		filenamePollers = append(filenamePollers, &f)
-		go f.startFilenamePoller()
-	}
+func startTails(config *Config, lg *logGroup, tsd_pushers []chan []string, offsets *tailOffsets) *filenamePoller {
+	f := filenamePoller{lg: lg, poll_interval: config.pollInterval, tsd_pushers: tsd_pushers, push_number: config.GetPusherNumber(),
+		offsets: offsets, Bye: make(chan bool), done: make(chan bool)}
+	go f.startFilenamePoller()
 
-	return filenamePollers
+	return &f
 }
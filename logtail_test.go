@@ -0,0 +1,107 @@
+package logmetrics
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// Tails filename until nb_lines are matched then stops, returning the first group of each
+func runTailer(t *testing.T, lg *logGroup, filename string, offsets *tailOffsets, nb_lines int) []string {
+	tl := tailer{filename: filename, lg: lg, offsets: offsets, tsd_pusher: make(chan []string, 10),
+		Bye: make(chan bool), done: make(chan bool)}
+	go tl.tailFile()
+
+	var lines []string
+	for len(lines) < nb_lines {
+		select {
+		case result := <-lg.tail_data[0]:
+			lines = append(lines, result.matches[1])
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected %d lines, got %v", nb_lines, lines)
+		}
+	}
+
+	tl.Bye <- true
+	<-tl.done
+
+	return lines
+}
+
+func TestTailerResumesFromSavedOffset(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "app.log")
+	if err := ioutil.WriteFile(filename, []byte("first\nsecond\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	conf := &logGroupConfig{Format: "regex", RegexEngine: "re2", Goroutines: 1, ParseFromStart: true,
+		Re: []regexConfig{{Re: `^(\w+)$`}}}
+	lg := newLogGroup("app", conf)
+	offsets := &tailOffsets{offsets: make(map[string]fileOffset)}
+
+	if lines := runTailer(t, lg, filename, offsets, 2); lines[0] != "first" || lines[1] != "second" {
+		t.Fatalf("unexpected lines %v", lines)
+	}
+	if saved, ok := offsets.get(filename); !ok || saved.Offset != 13 {
+		t.Fatalf("expected the offset after the second line to be saved, got %+v", saved)
+	}
+
+	//Only what came after is read again
+	f, err := os.OpenFile(filename, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("third\n")
+	f.Close()
+
+	if lines := runTailer(t, lg, filename, offsets, 1); lines[0] != "third" {
+		t.Fatalf("expected to resume at the third line, got %v", lines)
+	}
+	if saved, _ := offsets.get(filename); saved.Offset != 19 {
+		t.Errorf("expected offset 19, got %d", saved.Offset)
+	}
+
+	//Another file at the same path starts over
+	rotated := filename + ".new"
+	if err := ioutil.WriteFile(rotated, []byte("fourth\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(rotated, filename); err != nil {
+		t.Fatal(err)
+	}
+
+	if lines := runTailer(t, lg, filename, offsets, 1); lines[0] != "fourth" {
+		t.Fatalf("expected a rotated file to be read from the start, got %v", lines)
+	}
+}
+
+func TestFilenamePollerStopLeavesNoGoroutines(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.log", "b.log"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("line\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	before := runtime.NumGoroutine()
+
+	//Stopped and started again, like on SIGHUP
+	for i := 0; i < 3; i++ {
+		lg := &logGroup{name: "test", globFiles: []string{filepath.Join(dir, "*.log")}, goroutines: 1, interval: 60,
+			tail_data: []chan lineResult{make(chan lineResult, 10)}}
+		fp := startTails(&Config{pollInterval: 1, pushNumber: 1}, lg, []chan []string{make(chan []string, 10)}, nil)
+		time.Sleep(50 * time.Millisecond)
+		fp.Stop()
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d goroutines once the pollers stopped, got %d", before, runtime.NumGoroutine())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
 	"log/syslog"
 	"os"
@@ -19,11 +20,32 @@ var threads = flag.Int("j", 1, "Thread count.")
 var logToConsole = flag.Bool("d", false, "Print to console.")
 var doNotSend = flag.Bool("D", false, "Print data instead of sending over network.")
 var profile = flag.String("P", "", "Create a pprof file with this filename.")
+var checkConfig = flag.Bool("t", false, "Check the config file and exit.")
+var dumpConfig = flag.Bool("dump-config", false, "Print the config with every default filled in and exit.")
 
 func main() {
 	//Process execution flags
 	flag.Parse()
 
+	if *checkConfig {
+		if _, err := logmetrics.ParseConfig(*configFile); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("%s: OK\n", *configFile)
+		os.Exit(0)
+	}
+
+	if *dumpConfig {
+		config, err := logmetrics.ParseConfig(*configFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(1)
+		}
+		fmt.Print(config.Dump())
+		os.Exit(0)
+	}
+
 	var pf *os.File
 	if *profile != "" {
 		var err error
@@ -49,8 +71,16 @@ func main() {
 		s := <-sigc
 		log.Printf("Received signal: %s", s)
 		stop <- true
+
+		//Don't wait on a stuck shutdown when asked twice
+		s = <-sigc
+		log.Printf("Received signal: %s while stopping, exiting now", s)
+		os.Exit(1)
 	}()
 
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+
 	//Set the number of real threads to start
 	runtime.GOMAXPROCS(*threads)
 
@@ -76,33 +106,65 @@ func main() {
 		tsd_pushers[i] = make(chan []string, 1000)
 	}
 
-	//Start log tails
-	fps := logmetrics.StartTails(&config, tsd_pushers)
+	//Saved tail positions from a previous run
+	offsets := logmetrics.LoadTailOffsets(&config)
+
+	//Optional Prometheus endpoint
+	snapshots := logmetrics.StartPrometheusExporter(&config)
 
-	//Start datapools
-	dps := logmetrics.StartDataPools(&config, tsd_pushers)
+	//Start datapools and log tails
+	groups := logmetrics.StartLogGroups(&config, tsd_pushers, offsets, snapshots, *doNotSend)
 
 	//Start TSD pusher
 	ps := logmetrics.StartTsdPushers(&config, tsd_pushers, *doNotSend)
 
-	//Block until we're told to stop
-	<-stop
+	//Block until we're told to stop, reloading log groups on SIGHUP
+	for running := true; running; {
+		select {
+		case <-stop:
+			running = false
+		case <-sighup:
+			log.Printf("Reloading %s", *configFile)
+			newConfig, err := logmetrics.ParseConfig(*configFile)
+			if err != nil {
+				log.Printf("Invalid config, keeping the current one: %s", err)
+				continue
+			}
+			groups.Reload(&newConfig)
+		}
+	}
 
 	log.Print("Stopping all goroutines...")
 
-	//Stop file checkers
-	for _, fp := range fps {
-		fp.Bye <- true
-	}
+	//Stop in the order data flows so nothing already read is lost
+	stopped := make(chan bool)
+	go func() {
+		//Stop file checkers and their tailers
+		groups.StopTails()
+
+		//Persist tail positions
+		if offsets != nil {
+			offsets.Bye <- true
+			if err := offsets.Save(); err != nil {
+				log.Printf("Unable to save tail offsets: %s", err)
+			}
+		}
 
-	//Stop data pools
-	for _, dp := range dps {
-		dp.Bye <- true
-	}
+		//Stop data pools after a last push of their keys
+		groups.StopDataPools()
+
+		//Stop tsd pushers once their queue is sent
+		for _, ps := range ps {
+			ps.Stop()
+		}
+
+		stopped <- true
+	}()
 
-	//Stop tsd pushers
-	for _, ps := range ps {
-		ps.Bye <- true
+	select {
+	case <-stopped:
+	case <-time.After(config.GetShutdownTimeout()):
+		log.Printf("Unable to stop cleanly within %s, exiting anyway", config.GetShutdownTimeout())
 	}
 
 	if *profile != "" {
@@ -43,7 +43,6 @@ func (f *readStats) isTimeForStats(interval int) bool {
 }
 
 func parserTest(filename string, lg *logGroup, perfInfo bool) {
-	maxMatches := lg.expected_matches + 1
 
 	file, err := os.Open(filename)
 	if err != nil {
@@ -59,12 +58,19 @@ func parserTest(filename string, lg *logGroup, perfInfo bool) {
 	for scanner.Scan() {
 		line := scanner.Text()
 
-		//Test out all the regexp, pick the first one that matches
 		match_one := false
-		for _, re := range lg.re {
-			m := re.MatcherString(line, 0)
-			matches := m.ExtractString()
-			if len(matches) == maxMatches {
+		if lg.fields != nil {
+			_, err := lg.fields.parse(line, nil)
+			match_one = err == nil
+			if lg.fail_regex_warn && err != nil {
+				log.Printf("Json decode failed on %s: %s: %s", filename, err, line)
+			}
+		}
+
+		//Test out all the regexp, pick the first one that matches
+		for i, re := range lg.re {
+			matches := re.findSubmatch(line)
+			if len(matches) == lg.mappings[i].expected_matches+1 {
 
 				match_one = true
 			}
@@ -72,8 +78,8 @@ func parserTest(filename string, lg *logGroup, perfInfo bool) {
 
 		read_stats.inc(match_one, len(line))
 
-		if lg.fail_regex_warn && !match_one {
-			log.Printf("Regexp match failed on %s, expected %d matches: %s", filename, maxMatches, line)
+		if lg.fail_regex_warn && !match_one && lg.fields == nil {
+			log.Printf("Regexp match failed on %s: %s", filename, line)
 		}
 
 		if read_stats.isTimeForStats(1) {
@@ -0,0 +1,202 @@
+package logmetrics
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Latest keys pushed for a tsdPoint, kept by the datapools for the /metrics endpoint
+type metricSnapshot struct {
+	metric_type string
+	base        string
+	lines       []string
+}
+
+// Datapools own their data and run on their own goroutine. Instead of reading dp.data
+// they publish a copy of their latest keys here after each push.
+type snapshotRegistry struct {
+	mu        sync.Mutex
+	datapools map[string]map[string]metricSnapshot
+}
+
+func newSnapshotRegistry() *snapshotRegistry {
+	return &snapshotRegistry{datapools: make(map[string]map[string]metricSnapshot)}
+}
+
+func (sr *snapshotRegistry) publish(datapool_name string, snapshots map[string]metricSnapshot) {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+
+	sr.datapools[datapool_name] = snapshots
+}
+
+func (sr *snapshotRegistry) remove(datapool_name string) {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+
+	delete(sr.datapools, datapool_name)
+}
+
+func (sr *snapshotRegistry) get() []metricSnapshot {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+
+	all := make([]metricSnapshot, 0)
+	for _, snapshots := range sr.datapools {
+		for _, snapshot := range snapshots {
+			all = append(all, snapshot)
+		}
+	}
+
+	return all
+}
+
+// The metric part of a datapool key, "<key_prefix>.<key_suffix>.%s %d %s <tags>"
+func getKeyBase(tsd_key string) string {
+	if pos := strings.Index(tsd_key, ".%s"); pos > 0 {
+		return tsd_key[:pos]
+	}
+
+	return tsd_key
+}
+
+func cleanPromName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '_' || r == ':' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+var promLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+var promQuantiles = map[string]string{
+	"p50":  "0.5",
+	"p75":  "0.75",
+	"p95":  "0.95",
+	"p99":  "0.99",
+	"p999": "0.999",
+}
+
+type promFamily struct {
+	metric_type string
+	samples     []string
+}
+
+type promFamilies map[string]*promFamily
+
+func (pf promFamilies) addSample(name string, metric_type string, labels []string, value string) {
+	pf.addFamilySample(name, name, metric_type, labels, value)
+}
+
+// For samples named after their family, like a summary's _count
+func (pf promFamilies) addFamilySample(name string, sample_name string, metric_type string, labels []string, value string) {
+	family, ok := pf[name]
+	if !ok {
+		family = &promFamily{metric_type: metric_type}
+		pf[name] = family
+	}
+
+	sample := sample_name
+	if len(labels) > 0 {
+		sample += "{" + strings.Join(labels, ",") + "}"
+	}
+	family.samples = append(family.samples, sample+" "+value)
+}
+
+// Meters become counters plus rate gauges, histograms summaries with their count plus gauges for the other stats
+func (pf promFamilies) addSnapshot(snapshot metricSnapshot) {
+	base := cleanPromName(snapshot.base)
+
+	for _, line := range snapshot.lines {
+		l, err := parseTsdLine(line)
+		if err != nil {
+			continue
+		}
+
+		labels := make([]string, 0, len(l.tags)+1)
+		for _, t := range l.tags {
+			labels = append(labels, fmt.Sprintf(`%s="%s"`, cleanPromName(t.key), promLabelEscaper.Replace(t.value)))
+		}
+
+		stat := strings.TrimPrefix(l.metric, snapshot.base+".")
+
+		switch {
+		case stat == "count" && (snapshot.metric_type == "meter" || snapshot.metric_type == "counter"):
+			pf.addSample(base+"_total", "counter", labels, l.value)
+
+		case stat == "count" && snapshot.metric_type == "histogram":
+			pf.addFamilySample(base, base+"_count", "summary", labels, l.value)
+
+		case snapshot.metric_type == "histogram" && promQuantiles[stat] != "":
+			labels = append(labels, fmt.Sprintf(`quantile="%s"`, promQuantiles[stat]))
+			pf.addSample(base, "summary", labels, l.value)
+
+		default:
+			pf.addSample(base+"_"+cleanPromName(strings.Replace(stat, "._", "_", -1)), "gauge", labels, l.value)
+		}
+	}
+}
+
+type promExporter struct {
+	snapshots *snapshotRegistry
+}
+
+func (pe *promExporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	families := make(promFamilies)
+	for _, snapshot := range pe.snapshots.get() {
+		families.addSnapshot(snapshot)
+	}
+
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	for _, name := range names {
+		family := families[name]
+		sort.Strings(family.samples)
+
+		fmt.Fprintf(&buf, "# TYPE %s %s\n", name, family.metric_type)
+		for _, sample := range family.samples {
+			buf.WriteString(sample + "\n")
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buf.Bytes())
+}
+
+func StartPrometheusExporter(config *Config) *snapshotRegistry {
+	if config.prometheusListen == "" {
+		return nil
+	}
+
+	listener, err := net.Listen("tcp", config.prometheusListen)
+	if err != nil {
+		log.Fatalf("Unable to listen on %s: %s", config.prometheusListen, err)
+	}
+
+	snapshots := newSnapshotRegistry()
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", &promExporter{snapshots: snapshots})
+
+	go func() {
+		log.Printf("Serving Prometheus metrics on %s/metrics", config.prometheusListen)
+		if err := http.Serve(listener, mux); err != nil {
+			log.Printf("Prometheus endpoint stopped: %s", err)
+		}
+	}()
+
+	return snapshots
+}
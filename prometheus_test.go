@@ -0,0 +1,44 @@
+package logmetrics
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPromExporterOutput(t *testing.T) {
+	snapshots := newSnapshotRegistry()
+	snapshots.publish("app", map[string]metricSnapshot{
+		"hits": {metric_type: "meter", base: "app.hits", lines: []string{
+			"app.hits.count 1500000000 42 host=web1",
+			"app.hits.rate._1min 1500000000 0.700 host=web1",
+		}},
+		"latency": {metric_type: "histogram", base: "app.latency", lines: []string{
+			"app.latency.count 1500000000 10 host=web1 path=/a\"b",
+			"app.latency.min 1500000000 1 host=web1 path=/a\"b",
+			"app.latency.p50 1500000000 5 host=web1 path=/a\"b",
+			"app.latency.p999 1500000000 9 host=web1 path=/a\"b",
+		}},
+	})
+
+	w := httptest.NewRecorder()
+	(&promExporter{snapshots: snapshots}).ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	//The histogram's count is the summary's own _count, not a gauge of its own
+	expected := `# TYPE app_hits_rate_1min gauge
+app_hits_rate_1min{host="web1"} 0.700
+# TYPE app_hits_total counter
+app_hits_total{host="web1"} 42
+# TYPE app_latency summary
+app_latency_count{host="web1",path="/a\"b"} 10
+app_latency{host="web1",path="/a\"b",quantile="0.5"} 5
+app_latency{host="web1",path="/a\"b",quantile="0.999"} 9
+# TYPE app_latency_min gauge
+app_latency_min{host="web1",path="/a\"b"} 1
+`
+	if body := w.Body.String(); body != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, body)
+	}
+	if content_type := w.Header().Get("Content-Type"); content_type != "text/plain; version=0.0.4" {
+		t.Errorf("unexpected content type %s", content_type)
+	}
+}
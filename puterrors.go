@@ -0,0 +1,97 @@
+package logmetrics
+
+import (
+	"bufio"
+	"log"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Number of lines kept around to find out which key a TSD error is about
+const putErrorRecentLines = 1000
+
+// TSD quotes the offending metric or tag in most of its put errors, ie:
+// put: illegal argument: Invalid metric name ("foo bar"): illegal character: ' '
+// put: unknown metric: No such name for 'metrics': 'foo.bar'
+var putErrorQuoted = regexp.MustCompile(`\("([^"]*)"\)|'([^']*)'$`)
+
+// TSD only answers a telnet put when something went wrong. Reads those answers
+// back from the connection, counts them and optionally logs them along with the
+// key they're about when it can be found in the lines recently sent.
+type putErrorReader struct {
+	log_errors bool
+	count      int64
+
+	mu     sync.Mutex
+	recent []string
+	next   int
+}
+
+func newPutErrorReader(config *Config) *putErrorReader {
+	return &putErrorReader{log_errors: config.pushLogErrors, recent: make([]string, putErrorRecentLines)}
+}
+
+func (r *putErrorReader) addSent(data []byte) {
+	r.mu.Lock()
+	r.recent[r.next] = string(data)
+	r.next = (r.next + 1) % len(r.recent)
+	r.mu.Unlock()
+}
+
+func (r *putErrorReader) getCount() int64 {
+	return atomic.LoadInt64(&r.count)
+}
+
+// Newest sent key containing the quoted part of the error, if any
+func (r *putErrorReader) findKey(put_error string) string {
+	m := putErrorQuoted.FindStringSubmatch(put_error)
+	if m == nil {
+		return ""
+	}
+	quoted := m[1] + m[2]
+	if quoted == "" {
+		return ""
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i := 1; i <= len(r.recent); i++ {
+		line := r.recent[(r.next-i+len(r.recent))%len(r.recent)]
+		if line == "" {
+			break
+		}
+
+		if strings.Contains(line, quoted) {
+			if fields := strings.Fields(line); len(fields) > 1 {
+				return fields[1]
+			}
+		}
+	}
+
+	return ""
+}
+
+// Runs until the connection is closed
+func (r *putErrorReader) read(conn net.Conn) {
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		put_error := strings.TrimSpace(scanner.Text())
+		if put_error == "" {
+			continue
+		}
+
+		atomic.AddInt64(&r.count, 1)
+
+		if r.log_errors {
+			if key := r.findKey(put_error); key != "" {
+				log.Printf("TSD %s rejected %s: %s", conn.RemoteAddr(), key, put_error)
+			} else {
+				log.Printf("TSD %s returned: %s", conn.RemoteAddr(), put_error)
+			}
+		}
+	}
+}
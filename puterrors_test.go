@@ -0,0 +1,49 @@
+package logmetrics
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestPutErrorReader(t *testing.T) {
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	log.SetFlags(0)
+	defer log.SetOutput(os.Stderr)
+	defer log.SetFlags(log.LstdFlags)
+
+	r := newPutErrorReader(&Config{pushLogErrors: true})
+	r.addSent([]byte("put app.hits.count 1500000000 3 host=x\n"))
+	r.addSent([]byte("put app.bad name 1500000000 3 host=x\n"))
+	r.addSent([]byte("put app.latency.p99 1500000000 12 host=x\n"))
+
+	client, tsd := net.Pipe()
+	done := make(chan bool)
+	go func() {
+		r.read(client)
+		close(done)
+	}()
+
+	tsd.Write([]byte("put: unknown metric: No such name for 'metrics': 'app.latency.p99'\n\n" +
+		"put: illegal argument: Invalid metric name (\"app.bad name\"): illegal character: ' '\n" +
+		"put: HBase error: timeout\n"))
+	tsd.Close()
+	<-done
+
+	if count := r.getCount(); count != 3 {
+		t.Errorf("expected 3 errors counted, got %d", count)
+	}
+
+	expected := []string{
+		"TSD pipe rejected app.latency.p99: put: unknown metric: No such name for 'metrics': 'app.latency.p99'",
+		"TSD pipe rejected app.bad: put: illegal argument: Invalid metric name (\"app.bad name\"): illegal character: ' '",
+		"TSD pipe returned: put: HBase error: timeout",
+	}
+	if logged.String() != strings.Join(expected, "\n")+"\n" {
+		t.Errorf("expected logged lines\n%s\ngot\n%s", strings.Join(expected, "\n"), logged.String())
+	}
+}
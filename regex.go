@@ -0,0 +1,82 @@
+package logmetrics
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// A compiled regex, whatever the engine behind it
+type regexMatcher interface {
+	//Whole match followed by every capture group, nil when it doesn't match
+	findSubmatch(s string) []string
+	match(s string) bool
+	groups() int
+	//Name of every group, "" for the whole match and unnamed groups
+	groupNames() []string
+}
+
+// Engines available in this build, by regex_engine name. pcre needs cgo.
+var regexEngines = map[string]func(pattern string) (regexMatcher, error){
+	"re2": compileRe2,
+}
+
+// pcre unless built without cgo
+func defaultRegexEngine() string {
+	if _, found := regexEngines["pcre"]; found {
+		return "pcre"
+	}
+	return "re2"
+}
+
+func compileRegex(engine string, pattern string) (regexMatcher, error) {
+	compile, found := regexEngines[engine]
+	if !found {
+		return nil, fmt.Errorf("regex engine %s isn't available in this build", engine)
+	}
+
+	return compile(pattern)
+}
+
+func checkRegexEngine(engine string) error {
+	switch engine {
+	case "re2", "pcre":
+	default:
+		return fmt.Errorf("unknown regex engine %s, expected re2 or pcre", engine)
+	}
+
+	if _, found := regexEngines[engine]; !found {
+		return fmt.Errorf("regex engine %s isn't available in this build, it needs cgo", engine)
+	}
+
+	return nil
+}
+
+// Go's own regexp, no cgo needed
+type re2Matcher struct {
+	re *regexp.Regexp
+}
+
+func compileRe2(pattern string) (regexMatcher, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	return &re2Matcher{re: re}, nil
+}
+
+func (m *re2Matcher) findSubmatch(s string) []string {
+	return m.re.FindStringSubmatch(s)
+}
+
+func (m *re2Matcher) match(s string) bool {
+	return m.re.MatchString(s)
+}
+
+func (m *re2Matcher) groups() int {
+	return m.re.NumSubexp()
+}
+
+func (m *re2Matcher) groupNames() []string {
+	return m.re.SubexpNames()
+}
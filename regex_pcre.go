@@ -0,0 +1,100 @@
+//go:build cgo
+// +build cgo
+
+package logmetrics
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/mathpl/golang-pkg-pcre/src/pkg/pcre"
+)
+
+func init() {
+	regexEngines["pcre"] = compilePcre
+}
+
+// libpcre bindings
+type pcreMatcher struct {
+	re    pcre.Regexp
+	names []string
+}
+
+func compilePcre(pattern string) (regexMatcher, error) {
+	re, err := pcre.Compile(pattern, 0)
+	if err != nil {
+		return nil, errors.New(err.Message)
+	}
+
+	return &pcreMatcher{re: re, names: pcreGroupNames(pattern)}, nil
+}
+
+func (m *pcreMatcher) findSubmatch(s string) []string {
+	return m.re.MatcherString(s, 0).ExtractString()
+}
+
+func (m *pcreMatcher) match(s string) bool {
+	return m.re.MatcherString(s, 0).Matches()
+}
+
+func (m *pcreMatcher) groups() int {
+	return m.re.Groups()
+}
+
+func (m *pcreMatcher) groupNames() []string {
+	return m.names
+}
+
+// The bindings don't expose pcre's name table, groups are found in the pattern:
+// (?P<name>...), (?<name>...) and (?'name'...) are named, (?...) other than those
+// don't capture.
+func pcreGroupNames(pattern string) []string {
+	names := []string{""}
+	in_class := false
+
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; {
+		case c == '\\':
+			i++
+		case in_class:
+			in_class = c != ']'
+		case c == '[':
+			in_class = true
+			//A ] right at the start of a class is literal
+			if strings.HasPrefix(pattern[i+1:], "^") {
+				i++
+			}
+			if strings.HasPrefix(pattern[i+1:], "]") {
+				i++
+			}
+		case c == '(':
+			rest := pattern[i+1:]
+			if !strings.HasPrefix(rest, "?") && !strings.HasPrefix(rest, "*") {
+				names = append(names, "")
+			} else if name, found := pcreGroupName(rest); found {
+				names = append(names, name)
+			}
+		}
+	}
+
+	return names
+}
+
+func pcreGroupName(group string) (string, bool) {
+	var end string
+	switch {
+	case strings.HasPrefix(group, "?P<"):
+		group, end = group[3:], ">"
+	case strings.HasPrefix(group, "?<") && !strings.HasPrefix(group, "?<=") && !strings.HasPrefix(group, "?<!"):
+		group, end = group[2:], ">"
+	case strings.HasPrefix(group, "?'"):
+		group, end = group[2:], "'"
+	default:
+		return "", false
+	}
+
+	if i := strings.Index(group, end); i > 0 {
+		return group[:i], true
+	}
+	return "", false
+}
@@ -0,0 +1,12 @@
+//go:build cgo
+// +build cgo
+
+package logmetrics
+
+import (
+	"testing"
+)
+
+func BenchmarkMatchPcre(b *testing.B) {
+	benchmarkMatch(b, "pcre")
+}
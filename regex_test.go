@@ -0,0 +1,44 @@
+package logmetrics
+
+import (
+	"strings"
+	"testing"
+)
+
+// The example regex of the README as the config file hands it over: extended style,
+// its lines folded into one by YAML
+var readmeRegex = strings.Join([]string{
+	`([A-z]{3}\s+\d+\s+\d+:\d+:\d+)\s+                           # Date 1 \n`,
+	`(([a-z])+\d+\.\S+)\s+                                       # server 2, class 3,\n`,
+	`rest_([a-z]+)\.api:.*                                       # rest type 4 \n`,
+	`\[c:(\S+)\].*                                               # call 5 \n`,
+	`\(([0-9]+)\)\s+                                             # call time 6 \n`,
+	`\[bnt:([0-9]+)/([0-9]+)\]\s+                                # bnt calls 7, bnt time 8 \n`,
+	`\[sql:([0-9]+)/([0-9]+)\]\s+                                # sql calls 9, sql time 10 \n`,
+	`\[membase:([0-9]+)/([0-9]+)\]\s+                            # membase calls 11, membase time 12 \n`,
+	`\[memcache:([0-9]+)/([0-9]+)\]\s+                           # memcache calls 13, memcache time 14 \n`,
+	`\[other:([0-9]+)/([0-9]+)\].*                               # other calls 15, other time 16 \n`,
+}, " ")
+
+const readmeLine = "Feb  8 04:02:26 rest1.mynetwork rest_sales.api: [INFO] [performance] (http-2350-92) " +
+	"[c:session.addItem] [s:d9ea09bf2612060d9] [r:141915]  (34) [bnt:1/28] [sql:2/1] [membase:0/0] [memcache:4/2] [other:0/0]"
+
+func benchmarkMatch(b *testing.B, engine string) {
+	_, re, err := cleanSre2(engine, readmeRegex)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if matches := re.findSubmatch(readmeLine); len(matches) != 17 {
+		b.Fatalf("expected the README line to match with 16 groups, got %d", len(matches)-1)
+	}
+
+	b.SetBytes(int64(len(readmeLine)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		re.findSubmatch(readmeLine)
+	}
+}
+
+func BenchmarkMatchRe2(b *testing.B) {
+	benchmarkMatch(b, "re2")
+}
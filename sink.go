@@ -0,0 +1,388 @@
+package logmetrics
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Keep datagrams under the usual jumbo-less MTU
+const maxDatagramPayload = 1400
+
+// A sink is where a pusher sends its keys. Lines are in the "name ts value tag=v ..."
+// format generated by the datapools and sinks convert them to whatever they output.
+// write blocks until the lines are sent, it's what propagates backpressure up to the tailers.
+type sink interface {
+	write(lines []string) int
+	flush()
+	close()
+	String() string
+}
+
+func newSink(config *Config, output *outputConfig, pusher_number int, do_not_send bool) sink {
+	switch output.pushStrategy {
+	case "round_robin":
+		//Each pusher starts on a different target
+		o := *output
+		o.pushHosts = rotateTargets(output.getTargets(), pusher_number)
+		return newOutputSink(config, &o, do_not_send)
+	case "hash":
+		return newHashSink(config, output, do_not_send)
+	}
+
+	return newOutputSink(config, output, do_not_send)
+}
+
+func newOutputSink(config *Config, output *outputConfig, do_not_send bool) sink {
+	switch output.pushType {
+	case "tsd":
+		s := newBufferedConnSink(config, output, do_not_send, formatTsdLine)
+		s.put_errors = newPutErrorReader(config)
+		return s
+	case "tcollector":
+		return &connSink{cfg: config, output: output, do_not_send: do_not_send, format: formatTcollectorLine}
+	case "tsd_http":
+		return newTsdHttpSink(config, output, do_not_send)
+	case "graphite":
+		return newGraphiteSink(config, output, do_not_send)
+	case "graphite_pickle":
+		return newGraphitePickleSink(config, output, do_not_send)
+	case "influx":
+		return newInfluxSink(config, output, do_not_send)
+	case "kafka":
+		return newKafkaSink(config, output, do_not_send)
+	default:
+		log.Fatalf("Unknown push_type %s", output.pushType)
+	}
+
+	return nil
+}
+
+// Sinks able to tell how many keys their output refused
+type putErrorCounter interface {
+	getPutErrors() int64
+}
+
+type tag struct {
+	key   string
+	value string
+}
+
+type tsdLine struct {
+	metric    string
+	timestamp int64
+	value     string
+	tags      []tag
+}
+
+func parseTsdLine(line string) (tsdLine, error) {
+	var l tsdLine
+
+	fields := strings.Fields(line)
+	if len(fields) < 3 {
+		return l, fmt.Errorf("not enough fields in line: %s", line)
+	}
+
+	l.metric = fields[0]
+
+	var err error
+	if l.timestamp, err = strconv.ParseInt(fields[1], 10, 64); err != nil {
+		return l, fmt.Errorf("invalid timestamp in line: %s", line)
+	}
+
+	if _, err = strconv.ParseFloat(fields[2], 64); err != nil {
+		return l, fmt.Errorf("invalid value in line: %s", line)
+	}
+	l.value = fields[2]
+
+	l.tags = make([]tag, len(fields)-3)
+	for i, t := range fields[3:] {
+		kv := strings.SplitN(t, "=", 2)
+		if len(kv) != 2 {
+			return l, fmt.Errorf("invalid tag %s in line: %s", t, line)
+		}
+		l.tags[i] = tag{key: kv[0], value: kv[1]}
+	}
+
+	return l, nil
+}
+
+// Keys are "<key_prefix>.<key_suffix>.<stat>" and each part can have dots. Outputs that
+// need them apart match keys against the known prefixes, longest first so the most
+// specific one wins. Shared by every sink and replaced when log groups are reloaded.
+type metricPrefixes struct {
+	mu       sync.RWMutex
+	prefixes []string
+}
+
+func newMetricPrefixes(prefixes []string) *metricPrefixes {
+	mp := metricPrefixes{}
+	mp.set(prefixes)
+
+	return &mp
+}
+
+func (mp *metricPrefixes) set(prefixes []string) {
+	sorted := append([]string(nil), prefixes...)
+	sort.Slice(sorted, func(i, j int) bool { return len(sorted[i]) > len(sorted[j]) })
+
+	mp.mu.Lock()
+	mp.prefixes = sorted
+	mp.mu.Unlock()
+}
+
+// The prefix and what follows it, false when no prefix matched
+func (mp *metricPrefixes) split(metric string) (string, string, bool) {
+	mp.mu.RLock()
+	defer mp.mu.RUnlock()
+
+	for _, prefix := range mp.prefixes {
+		if strings.HasPrefix(metric, prefix+".") {
+			return prefix, metric[len(prefix)+1:], true
+		}
+	}
+
+	return "", "", false
+}
+
+func getKeyPrefixes(logGroups map[string]*logGroup) []string {
+	key_prefixes := make([]string, 0, len(logGroups))
+	for _, lg := range logGroups {
+		key_prefixes = append(key_prefixes, lg.key_prefix)
+	}
+
+	return key_prefixes
+}
+
+// key_prefix.key_suffix of every metric
+func getKeyBases(logGroups map[string]*logGroup) []string {
+	var bases []string
+	for _, lg := range logGroups {
+		for _, m := range lg.usedMappings() {
+			for _, keyExtracts := range m.metrics {
+				for _, keyExtract := range keyExtracts {
+					bases = append(bases, lg.key_prefix+"."+keyExtract.key_suffix)
+				}
+			}
+		}
+	}
+
+	return bases
+}
+
+func formatTsdLine(line string) []byte {
+	return []byte("put " + line + "\n")
+}
+
+func formatTcollectorLine(line string) []byte {
+	return []byte(line)
+}
+
+// Stream or datagram sink, reconnects as needed and blocks until each write goes through.
+// Line based stream outputs are buffered and flushed on size or by the pusher every push_flush_interval_ms.
+type connSink struct {
+	cfg         *Config
+	output      *outputConfig
+	do_not_send bool
+	format      func(string) []byte
+
+	conn   net.Conn
+	writer *bufio.Writer
+
+	//Index in the output's targets, the first one is preferred
+	current      int
+	connected_at time.Time
+	backoff      backoff
+
+	put_errors *putErrorReader
+}
+
+func newBufferedConnSink(config *Config, output *outputConfig, do_not_send bool, format func(string) []byte) *connSink {
+	s := connSink{cfg: config, output: output, do_not_send: do_not_send, format: format}
+
+	//Datagrams have to go out one at a time
+	if output.pushProto == "tcp" {
+		s.writer = bufio.NewWriterSize(resendingWriter{&s}, config.pushFlushSize)
+	}
+
+	return &s
+}
+
+func (s *connSink) String() string {
+	targets := strings.Join(s.output.getTargets(), ", ")
+	if s.useTls() {
+		return fmt.Sprintf("%s over %s with TLS in %s format", targets, s.output.pushProto, s.output.pushType)
+	}
+	return fmt.Sprintf("%s over %s in %s format", targets, s.output.pushProto, s.output.pushType)
+}
+
+// TLS only makes sense on stream connections
+func (s *connSink) useTls() bool {
+	return s.output.pushTls != nil && s.output.pushProto == "tcp"
+}
+
+func (s *connSink) dial(target string) (net.Conn, error) {
+	if s.useTls() {
+		dialer := net.Dialer{Timeout: time.Duration(s.cfg.pushTimeout) * time.Second}
+		return tls.DialWithDialer(&dialer, "tcp", target, s.output.pushTls)
+	}
+
+	return net.Dial(s.output.pushProto, target)
+}
+
+func (s *connSink) write(lines []string) int {
+	byte_written := 0
+	for _, line := range lines {
+		if data := s.format(line); data != nil {
+			byte_written += s.send(data)
+		}
+	}
+
+	return byte_written
+}
+
+func (s *connSink) connect() bool {
+	if s.conn != nil {
+		return true
+	}
+
+	target := s.output.getTargets()[s.current]
+	if s.backoff.isClosed() {
+		log.Printf("Reconnecting to %s", target)
+	}
+
+	var err error
+	if s.conn, err = s.dial(target); err != nil {
+		s.nextTarget(fmt.Sprintf("Unable to reconnect to %s: %s", target, err))
+		return false
+	}
+	s.connected_at = time.Now()
+
+	if s.put_errors != nil {
+		go s.put_errors.read(s.conn)
+	}
+
+	return true
+}
+
+func (s *connSink) disconnect(err error) {
+	s.conn.Close()
+	s.conn = nil
+	s.nextTarget(fmt.Sprintf("Error writting data to %s: %s", s.output.getTargets()[s.current], err))
+}
+
+// Moves on to the next target, only backs off once all of them failed
+func (s *connSink) nextTarget(msg string) {
+	s.current = (s.current + 1) % len(s.output.getTargets())
+	if s.current == 0 {
+		s.backoff.failed(s.cfg, msg)
+	} else if s.backoff.isClosed() {
+		log.Print(msg)
+	}
+}
+
+func (s *connSink) getBackoffs() []*backoff {
+	return []*backoff{&s.backoff}
+}
+
+func (s *connSink) send(data []byte) int {
+	if s.do_not_send {
+		fmt.Print(string(data) + "\n")
+		return len(data)
+	}
+
+	if s.put_errors != nil {
+		s.put_errors.addSent(data)
+	}
+
+	if s.writer != nil {
+		s.writer.Write(data)
+		return len(data)
+	}
+
+	for {
+		if s.backoff.failFast(1) {
+			return 0
+		}
+		if !s.connect() {
+			continue
+		}
+
+		if _, err := s.conn.Write(data); err != nil {
+			s.disconnect(err)
+		} else {
+			s.backoff.succeeded()
+			break
+		}
+	}
+
+	return len(data)
+}
+
+func (s *connSink) getPutErrors() int64 {
+	if s.put_errors == nil {
+		return 0
+	}
+	return s.put_errors.getCount()
+}
+
+func (s *connSink) flush() {
+	if s.writer != nil {
+		s.writer.Flush()
+	}
+
+	//Back to the preferred target once in a while
+	if s.current != 0 && s.conn != nil && time.Now().Sub(s.connected_at) > time.Duration(s.cfg.pushFailbackInterval)*time.Second {
+		log.Printf("Failing back to %s", s.output.getTargets()[0])
+		s.conn.Close()
+		s.conn = nil
+		s.current = 0
+	}
+}
+
+func (s *connSink) close() {
+	s.flush()
+
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+}
+
+// What the buffered writer flushes to. Blocks until everything went through,
+// after a failed write the line that was cut is sent again whole on the new connection.
+type resendingWriter struct {
+	s *connSink
+}
+
+func (w resendingWriter) Write(data []byte) (int, error) {
+	written := 0
+	for written < len(data) {
+		if w.s.backoff.failFast(bytes.Count(data[written:], []byte("\n"))) {
+			return len(data), nil
+		}
+		if !w.s.connect() {
+			continue
+		}
+
+		n, err := w.s.conn.Write(data[written:])
+		if err != nil {
+			//Back to the end of the last complete line
+			written = bytes.LastIndexByte(data[:written+n], '\n') + 1
+			w.s.disconnect(err)
+			continue
+		}
+		written += n
+		w.s.backoff.succeeded()
+	}
+
+	return len(data), nil
+}
@@ -0,0 +1,169 @@
+package logmetrics
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestConfig() *Config {
+	return &Config{pushWait: 1, pushMaxWait: 1, pushBackoffFactor: 2, pushBreakerThreshold: 5, pushFlushSize: 32768,
+		pushTimeout: 5, pushFailbackInterval: 60, pushRetries: 3, pushBatchSize: 50}
+}
+
+// Local TCP sink, what every connection sent ends up in received
+type tcpListener struct {
+	net.Listener
+
+	mu       sync.Mutex
+	received bytes.Buffer
+	discard  bool
+}
+
+func newTcpListener(t testing.TB, discard bool) *tcpListener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l := &tcpListener{Listener: ln, discard: discard}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go l.read(conn)
+		}
+	}()
+	t.Cleanup(func() { ln.Close() })
+
+	return l
+}
+
+func (l *tcpListener) read(conn net.Conn) {
+	defer conn.Close()
+
+	if l.discard {
+		io.Copy(ioutil.Discard, conn)
+		return
+	}
+
+	buf := make([]byte, 4096)
+	for {
+		n, err := conn.Read(buf)
+		l.mu.Lock()
+		l.received.Write(buf[:n])
+		l.mu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (l *tcpListener) getReceived() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.received.String()
+}
+
+func (l *tcpListener) waitFor(t *testing.T, expected string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for l.getReceived() != expected {
+		if time.Now().After(deadline) {
+			t.Fatalf("listener received %q, expected %q", l.getReceived(), expected)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (l *tcpListener) output() *outputConfig {
+	return &outputConfig{pushHosts: []string{l.Addr().String()}, pushProto: "tcp", pushType: "tsd"}
+}
+
+// Takes limit bytes then fails, like a connection dropped in the middle of a write
+type partialConn struct {
+	net.Conn
+	limit   int
+	written bytes.Buffer
+}
+
+func (c *partialConn) Write(data []byte) (int, error) {
+	if len(data) > c.limit {
+		c.written.Write(data[:c.limit])
+		return c.limit, errors.New("connection reset by peer")
+	}
+	c.written.Write(data)
+	c.limit -= len(data)
+	return len(data), nil
+}
+
+func (c *partialConn) Close() error {
+	return nil
+}
+
+func TestResendingWriterResendsCutLine(t *testing.T) {
+	l := newTcpListener(t, false)
+	s := newBufferedConnSink(newTestConfig(), l.output(), false, formatTcollectorLine)
+
+	cut := &partialConn{limit: 10}
+	s.conn = cut
+
+	data := "line1\nline2\nline3\n"
+	if n, err := (resendingWriter{s}).Write([]byte(data)); n != len(data) || err != nil {
+		t.Fatalf("Write returned %d, %v", n, err)
+	}
+	s.close()
+
+	if cut.written.String() != "line1\nline" {
+		t.Fatalf("unexpected write on the first connection %q", cut.written.String())
+	}
+	//line2 was cut, it's sent again whole with what follows
+	l.waitFor(t, "line2\nline3\n")
+}
+
+func TestBufferedConnSinkFlush(t *testing.T) {
+	l := newTcpListener(t, false)
+	s := newBufferedConnSink(newTestConfig(), l.output(), false, formatTsdLine)
+
+	s.write([]string{"a 1 1 host=x", "b 1 2 host=x"})
+	if received := l.getReceived(); received != "" {
+		t.Fatalf("expected lines to be buffered until flushed, got %q", received)
+	}
+
+	s.flush()
+	l.waitFor(t, "put a 1 1 host=x\nput b 1 2 host=x\n")
+	s.close()
+}
+
+func benchmarkConnSink(b *testing.B, s *connSink) {
+	lines := make([]string, 50)
+	for i := range lines {
+		lines[i] = fmt.Sprintf("app.execution_time.ms.p99 1391745767 %d call=getUser host=api1.mynetwork class=api", i)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.write(lines)
+	}
+	s.close()
+}
+
+// Lines go through the buffered writer, flushed by size
+func BenchmarkConnSinkBatched(b *testing.B) {
+	l := newTcpListener(b, true)
+	benchmarkConnSink(b, newBufferedConnSink(newTestConfig(), l.output(), false, formatTsdLine))
+}
+
+// One write on the connection per line
+func BenchmarkConnSinkPerLine(b *testing.B) {
+	l := newTcpListener(b, true)
+	benchmarkConnSink(b, &connSink{cfg: newTestConfig(), output: l.output(), format: formatTsdLine})
+}
@@ -0,0 +1,299 @@
+package logmetrics
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const spoolSegmentSize = 8 * 1024 * 1024
+
+// Sits between the datapools and a pusher. Batches go straight through while the
+// pusher keeps up. Once its channel is full they are appended to segment files on
+// disk instead and replayed in order as the pusher catches up. Anything received
+// while data is on disk goes to disk as well so ordering is kept.
+//
+// Segments are only removed once fully replayed so a restart can replay a few
+// batches twice, never lose them.
+type spool struct {
+	dir          string
+	max_size     int64
+	segment_size int64
+	drop_policy  string
+	number       int
+
+	in  chan []string
+	out chan []string
+
+	segments []int64
+	size     int64
+
+	writer      *os.File
+	writer_size int64
+
+	reader    *bufio.Reader
+	reader_fd *os.File
+	next      []string
+
+	dropped int64
+
+	Bye chan bool
+}
+
+func newSpool(config *Config, number int, in chan []string) *spool {
+	s := spool{dir: filepath.Join(config.spoolDir, fmt.Sprintf("pusher_%d", number)), number: number,
+		max_size: int64(config.spoolMaxSizeMb) * 1024 * 1024, drop_policy: config.spoolDropPolicy,
+		in: in, out: make(chan []string, cap(in)), Bye: make(chan bool)}
+
+	s.segment_size = spoolSegmentSize
+	if s.max_size > 0 && s.max_size/4 < s.segment_size {
+		s.segment_size = s.max_size / 4
+	}
+
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		log.Fatalf("Unable to create spool directory %s: %s", s.dir, err)
+	}
+
+	//Leftovers from a previous run are replayed first
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		log.Fatalf("Unable to read spool directory %s: %s", s.dir, err)
+	}
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), ".seg") {
+			continue
+		}
+		if id, err := strconv.ParseInt(strings.TrimSuffix(f.Name(), ".seg"), 10, 64); err == nil {
+			s.segments = append(s.segments, id)
+			s.size += f.Size()
+		}
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i] < s.segments[j] })
+
+	if len(s.segments) > 0 {
+		log.Printf("Spool[%d] replaying %d bytes left in %s", s.number, s.size, s.dir)
+	}
+
+	return &s
+}
+
+func (s *spool) getSegmentFilename(id int64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d.seg", id))
+}
+
+func (s *spool) hasSpilled() bool {
+	return len(s.segments) > 0
+}
+
+func (s *spool) isFull() bool {
+	return s.max_size > 0 && s.size >= s.max_size
+}
+
+func encodeSpoolRecord(keys []string) []byte {
+	payload := strings.Join(keys, "\n")
+	record := make([]byte, 4, 4+len(payload))
+	binary.BigEndian.PutUint32(record, uint32(len(payload)))
+
+	return append(record, payload...)
+}
+
+func (s *spool) rollSegment() error {
+	if s.writer != nil {
+		s.writer.Close()
+		s.writer = nil
+	}
+
+	var id int64
+	if len(s.segments) > 0 {
+		id = s.segments[len(s.segments)-1] + 1
+	}
+
+	f, err := os.OpenFile(s.getSegmentFilename(id), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	s.writer = f
+	s.writer_size = 0
+	s.segments = append(s.segments, id)
+
+	return nil
+}
+
+// False when nothing could be dropped
+func (s *spool) dropOldestSegment() bool {
+	//Never drop the one being written, start a new one first
+	if len(s.segments) == 1 && s.writer != nil {
+		if err := s.rollSegment(); err != nil {
+			log.Printf("Spool[%d] unable to create segment: %s", s.number, err)
+			return false
+		}
+	}
+
+	s.closeReader()
+	log.Printf("Spool[%d] full, dropping oldest segment %s", s.number, s.getSegmentFilename(s.segments[0]))
+	s.removeOldestSegment()
+
+	return true
+}
+
+func (s *spool) spill(keys []string) {
+	if s.isFull() {
+		switch s.drop_policy {
+		case "drop_newest":
+			s.dropped++
+			if s.dropped%1000 == 1 {
+				log.Printf("Spool[%d] full, %d batches dropped so far", s.number, s.dropped)
+			}
+			return
+		case "drop_oldest":
+			for s.isFull() && len(s.segments) > 0 {
+				if !s.dropOldestSegment() {
+					log.Printf("Spool[%d] full and unable to make room, dropping batch", s.number)
+					s.dropped++
+					return
+				}
+			}
+		}
+	}
+
+	if !s.hasSpilled() {
+		log.Printf("Spool[%d] pusher is behind, spilling to %s", s.number, s.dir)
+	}
+
+	if s.writer == nil || s.writer_size >= s.segment_size {
+		if err := s.rollSegment(); err != nil {
+			log.Printf("Spool[%d] unable to create segment, dropping batch: %s", s.number, err)
+			return
+		}
+	}
+
+	record := encodeSpoolRecord(keys)
+	if _, err := s.writer.Write(record); err != nil {
+		log.Printf("Spool[%d] unable to write to segment, dropping batch: %s", s.number, err)
+		return
+	}
+	s.writer_size += int64(len(record))
+	s.size += int64(len(record))
+}
+
+// Next batch on disk, nil when there's none left
+func (s *spool) readNext() []string {
+	for s.hasSpilled() {
+		if s.reader == nil {
+			f, err := os.Open(s.getSegmentFilename(s.segments[0]))
+			if err != nil {
+				log.Printf("Spool[%d] unable to open segment, skipping it: %s", s.number, err)
+				s.removeOldestSegment()
+				continue
+			}
+			s.reader_fd = f
+			s.reader = bufio.NewReader(f)
+		}
+
+		var length uint32
+		err := binary.Read(s.reader, binary.BigEndian, &length)
+		if err == nil {
+			payload := make([]byte, length)
+			if _, err = io.ReadFull(s.reader, payload); err == nil {
+				return strings.Split(string(payload), "\n")
+			}
+		}
+
+		if err != io.EOF {
+			log.Printf("Spool[%d] corrupted segment, skipping the rest of it: %s", s.number, err)
+		}
+
+		//Done with this segment. When it's the one being written we've caught up.
+		if len(s.segments) == 1 && s.writer != nil {
+			s.writer.Close()
+			s.writer = nil
+			log.Printf("Spool[%d] caught up", s.number)
+		}
+		s.closeReader()
+		s.removeOldestSegment()
+	}
+
+	return nil
+}
+
+func (s *spool) closeReader() {
+	if s.reader_fd != nil {
+		s.reader_fd.Close()
+		s.reader_fd = nil
+		s.reader = nil
+	}
+}
+
+func (s *spool) removeOldestSegment() {
+	filename := s.getSegmentFilename(s.segments[0])
+	if fi, err := os.Stat(filename); err == nil {
+		s.size -= fi.Size()
+	}
+	os.Remove(filename)
+	s.segments = s.segments[1:]
+
+	if len(s.segments) == 0 {
+		s.size = 0
+	}
+}
+
+func (s *spool) start() {
+	for {
+		if s.next == nil && s.hasSpilled() {
+			s.next = s.readNext()
+		}
+
+		//Only replay when there's something to replay
+		var out chan []string
+		if s.next != nil {
+			out = s.out
+		}
+
+		//Stop reading when full and set to block, like it would without a spool
+		in := s.in
+		if s.drop_policy == "block" && s.isFull() {
+			in = nil
+		}
+
+		select {
+		case keys := <-in:
+			if len(keys) == 0 {
+				continue
+			}
+
+			if s.next == nil && !s.hasSpilled() {
+				select {
+				case s.out <- keys:
+					continue
+				default:
+				}
+			}
+
+			s.spill(keys)
+		case out <- s.next:
+			s.next = nil
+		case <-s.Bye:
+			//What's still queued is kept on disk for the next run
+			for len(s.in) > 0 {
+				if keys := <-s.in; len(keys) > 0 {
+					s.spill(keys)
+				}
+			}
+			if s.writer != nil {
+				s.writer.Close()
+			}
+			s.closeReader()
+			log.Printf("Spool[%d] stopped.", s.number)
+			return
+		}
+	}
+}
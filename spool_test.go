@@ -0,0 +1,151 @@
+package logmetrics
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newTestSpool(dir string, drop_policy string) *spool {
+	config := &Config{spoolDir: dir, spoolDropPolicy: drop_policy}
+	return newSpool(config, 0, make(chan []string, 1))
+}
+
+func getSpoolBatch(i int) []string {
+	return []string{fmt.Sprintf("app.hits.count %d %d host=a", i, i), fmt.Sprintf("app.hits.count %d %d host=b", i, i)}
+}
+
+// Everything left on disk, in order
+func readSpool(s *spool) [][]string {
+	var batches [][]string
+	for keys := s.readNext(); keys != nil; keys = s.readNext() {
+		batches = append(batches, keys)
+	}
+
+	return batches
+}
+
+func TestSpoolRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	s := newTestSpool(dir, "block")
+
+	//Small segments so the batches span a few of them
+	s.segment_size = 100
+	for i := 0; i < 10; i++ {
+		s.spill(getSpoolBatch(i))
+	}
+	if len(s.segments) < 3 {
+		t.Fatalf("expected the batches to span several segments, got %d", len(s.segments))
+	}
+
+	batches := readSpool(s)
+	if len(batches) != 10 {
+		t.Fatalf("expected 10 batches, got %d", len(batches))
+	}
+	for i, keys := range batches {
+		if !reflect.DeepEqual(keys, getSpoolBatch(i)) {
+			t.Errorf("batch %d: expected %v, got %v", i, getSpoolBatch(i), keys)
+		}
+	}
+
+	if s.hasSpilled() || s.size != 0 {
+		t.Errorf("expected nothing left once replayed, %d segments and %d bytes", len(s.segments), s.size)
+	}
+	if files, _ := ioutil.ReadDir(s.dir); len(files) != 0 {
+		t.Errorf("expected replayed segments to be removed, %d left", len(files))
+	}
+}
+
+func TestSpoolReplaysInOrder(t *testing.T) {
+	s := newTestSpool(t.TempDir(), "block")
+	go s.start()
+
+	//Nobody reads at first so most of them end up on disk
+	for i := 0; i < 50; i++ {
+		s.in <- getSpoolBatch(i)
+	}
+
+	for i := 0; i < 50; i++ {
+		select {
+		case keys := <-s.out:
+			if !reflect.DeepEqual(keys, getSpoolBatch(i)) {
+				t.Fatalf("batch %d: expected %v, got %v", i, getSpoolBatch(i), keys)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected 50 batches, got %d", i)
+		}
+	}
+
+	s.Bye <- true
+}
+
+func TestSpoolSizeCap(t *testing.T) {
+	record_size := int64(len(encodeSpoolRecord(getSpoolBatch(0))))
+
+	//Room for 4 batches, one per segment
+	s := newTestSpool(t.TempDir(), "drop_newest")
+	s.max_size, s.segment_size = 4*record_size, record_size
+	for i := 0; i < 10; i++ {
+		s.spill(getSpoolBatch(i))
+	}
+	if s.dropped != 6 || s.size != s.max_size {
+		t.Fatalf("drop_newest: expected 6 batches dropped and the spool full, got %d dropped and %d bytes", s.dropped, s.size)
+	}
+	if batches := readSpool(s); len(batches) != 4 || !reflect.DeepEqual(batches[0], getSpoolBatch(0)) {
+		t.Errorf("drop_newest: expected the first 4 batches kept, got %v", batches)
+	}
+
+	s = newTestSpool(t.TempDir(), "drop_oldest")
+	s.max_size, s.segment_size = 4*record_size, record_size
+	for i := 0; i < 10; i++ {
+		s.spill(getSpoolBatch(i))
+	}
+	if s.size > s.max_size {
+		t.Fatalf("drop_oldest: expected at most %d bytes, got %d", s.max_size, s.size)
+	}
+	batches := readSpool(s)
+	if len(batches) != 4 || !reflect.DeepEqual(batches[0], getSpoolBatch(6)) || !reflect.DeepEqual(batches[3], getSpoolBatch(9)) {
+		t.Errorf("drop_oldest: expected the last 4 batches kept, got %v", batches)
+	}
+}
+
+func TestSpoolRecoversPartialSegment(t *testing.T) {
+	dir := t.TempDir()
+	s := newTestSpool(dir, "block")
+	for i := 0; i < 3; i++ {
+		s.spill(getSpoolBatch(i))
+	}
+	s.writer.Close()
+
+	//Killed in the middle of writing the last batch
+	filename := s.getSegmentFilename(s.segments[0])
+	fi, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(filename, fi.Size()-5); err != nil {
+		t.Fatal(err)
+	}
+
+	//Picked up by the next run, only the complete batches come back
+	s = newTestSpool(dir, "block")
+	if s.size != fi.Size()-5 {
+		t.Errorf("expected the leftover segment to count toward the size, got %d", s.size)
+	}
+	batches := readSpool(s)
+	if !reflect.DeepEqual(batches, [][]string{getSpoolBatch(0), getSpoolBatch(1)}) {
+		t.Errorf("expected the 2 complete batches, got %v", batches)
+	}
+	if s.hasSpilled() {
+		t.Errorf("expected the partial segment to be removed, %d left", len(s.segments))
+	}
+
+	//Spilling starts over cleanly
+	s.spill(getSpoolBatch(3))
+	if batches := readSpool(s); !reflect.DeepEqual(batches, [][]string{getSpoolBatch(3)}) {
+		t.Errorf("expected only the new batch, got %v", batches)
+	}
+}
@@ -0,0 +1,437 @@
+package logmetrics
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/mathpl/go-timemetrics"
+)
+
+const tailOffsetsFile = "tail_offsets.json"
+
+type fileOffset struct {
+	Dev    uint64 `json:"dev"`
+	Inode  uint64 `json:"inode"`
+	Offset int64  `json:"offset"`
+}
+
+func getFileOffset(filename string) (fileOffset, int64, error) {
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return fileOffset{}, 0, err
+	}
+
+	return newFileOffset(fi), fi.Size(), nil
+}
+
+func newFileOffset(fi os.FileInfo) fileOffset {
+	var fo fileOffset
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		fo.Dev = uint64(st.Dev)
+		fo.Inode = uint64(st.Ino)
+	}
+
+	return fo
+}
+
+func (fo fileOffset) sameFile(other fileOffset) bool {
+	return fo.Dev == other.Dev && fo.Inode == other.Inode
+}
+
+// Keeps track of where each tailer is in its file so a restart can resume
+// from there instead of the start or end of the file.
+type tailOffsets struct {
+	filename string
+	interval int
+
+	mu      sync.Mutex
+	offsets map[string]fileOffset
+
+	Bye chan bool
+}
+
+func LoadTailOffsets(config *Config) *tailOffsets {
+	if config.stateDir == "" {
+		return nil
+	}
+
+	to := tailOffsets{filename: filepath.Join(config.stateDir, tailOffsetsFile), interval: config.stateInterval,
+		offsets: make(map[string]fileOffset), Bye: make(chan bool)}
+
+	byteState, err := ioutil.ReadFile(to.filename)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Unable to read tail offsets from %s: %s", to.filename, err)
+		}
+		return &to
+	}
+
+	if err := json.Unmarshal(byteState, &to.offsets); err != nil {
+		log.Printf("Ignoring corrupted tail offsets in %s: %s", to.filename, err)
+		to.offsets = make(map[string]fileOffset)
+	}
+
+	return &to
+}
+
+func (to *tailOffsets) get(filename string) (fileOffset, bool) {
+	to.mu.Lock()
+	defer to.mu.Unlock()
+
+	fo, ok := to.offsets[filename]
+	return fo, ok
+}
+
+func (to *tailOffsets) set(filename string, fo fileOffset) {
+	to.mu.Lock()
+	defer to.mu.Unlock()
+
+	to.offsets[filename] = fo
+}
+
+func (to *tailOffsets) Save() error {
+	to.mu.Lock()
+	offsets := make(map[string]fileOffset)
+	for filename, fo := range to.offsets {
+		//Files that are gone will never be resumed
+		if _, err := os.Stat(filename); err == nil {
+			offsets[filename] = fo
+		}
+	}
+	to.mu.Unlock()
+
+	byteState, err := json.Marshal(offsets)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(to.filename, byteState)
+}
+
+func (to *tailOffsets) start() {
+	ticker := time.NewTicker(time.Duration(to.interval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := to.Save(); err != nil {
+				log.Printf("Unable to save tail offsets to %s: %s", to.filename, err)
+			}
+		case <-to.Bye:
+			return
+		}
+	}
+}
+
+// Write to a temporary file first so a crash never leaves a truncated state file behind
+func writeFileAtomic(filename string, data []byte) error {
+	tmpFilename := filename + ".tmp"
+	if err := ioutil.WriteFile(tmpFilename, data, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFilename, filename)
+}
+
+// Datapool checkpoints. timemetrics types only have unexported fields so gob can't
+// encode them, what's needed to rebuild each kind of metric is copied out instead.
+type counterState struct {
+	Count int64
+}
+
+type meterState struct {
+	Count  int64
+	Rate1  float64
+	Rate5  float64
+	Rate15 float64
+}
+
+type histogramState struct {
+	Count  int64
+	Values []int64
+}
+
+// What's read from the timemetrics types
+type metricCount interface {
+	Count() int64
+}
+
+type meterRates interface {
+	Rate1() float64
+	Rate5() float64
+	Rate15() float64
+}
+
+type histogramSample interface {
+	Sample() timemetrics.Sample
+}
+
+type sampleValues interface {
+	Values() []int64
+}
+
+type tsdPointState struct {
+	Counter   *counterState
+	Meter     *meterState
+	Histogram *histogramState
+	MaxTime   time.Time
+
+	MetricType       string
+	Filename         string
+	LastPush         time.Time
+	LastCrunchedPush time.Time
+	NeverStale       bool
+}
+
+func newTsdPointState(point *tsdPoint) (tsdPointState, error) {
+	state := tsdPointState{MaxTime: point.data.GetMaxTime(), MetricType: point.metric_type, Filename: point.filename,
+		LastPush: point.last_push, LastCrunchedPush: point.last_crunched_push, NeverStale: point.never_stale}
+
+	switch point.metric_type {
+	case "counter":
+		m, ok := point.data.(metricCount)
+		if !ok {
+			return state, fmt.Errorf("unable to read the count of a %T", point.data)
+		}
+		state.Counter = &counterState{Count: m.Count()}
+	case "meter":
+		m, ok := point.data.(metricCount)
+		r, has_rates := point.data.(meterRates)
+		if !ok || !has_rates {
+			return state, fmt.Errorf("unable to read the count and rates of a %T", point.data)
+		}
+		state.Meter = &meterState{Count: m.Count(), Rate1: r.Rate1(), Rate5: r.Rate5(), Rate15: r.Rate15()}
+	case "histogram":
+		var s sampleValues
+		m, ok := point.data.(metricCount)
+		h, has_sample := point.data.(histogramSample)
+		if ok && has_sample {
+			s, ok = h.Sample().(sampleValues)
+		}
+		if !ok || !has_sample {
+			return state, fmt.Errorf("unable to read the sample of a %T", point.data)
+		}
+		state.Histogram = &histogramState{Count: m.Count(), Values: s.Values()}
+	default:
+		return state, fmt.Errorf("unexpected metric type %s", point.metric_type)
+	}
+
+	return state, nil
+}
+
+// Counters get their count back. Meters aren't marked with their saved count, it would show as
+// a rate spike, restoredMetric reports it and the saved rates on top of a fresh meter instead.
+// Histograms get the values of their sample back, their count is corrected the same way.
+func (dp *datapool) restoreMetric(state tsdPointState) (timemetrics.Metric, error) {
+	data := dp.newMetric(state.MetricType, state.MaxTime)
+	if data == nil {
+		return nil, fmt.Errorf("unexpected metric type %s", state.MetricType)
+	}
+
+	switch {
+	case state.Counter != nil:
+		data.Update(state.MaxTime, state.Counter.Count)
+		return data, nil
+	case state.Meter != nil:
+		return &restoredMetric{Metric: data, saved_at: state.MaxTime, count: state.Meter.Count,
+			rates: [3]float64{state.Meter.Rate1, state.Meter.Rate5, state.Meter.Rate15}}, nil
+	case state.Histogram != nil:
+		//timemetrics doesn't expose the sample's weights, the values come back at the same one
+		for _, val := range state.Histogram.Values {
+			data.Update(state.MaxTime, val)
+		}
+		return &restoredMetric{Metric: data, saved_at: state.MaxTime,
+			count: state.Histogram.Count - int64(len(state.Histogram.Values))}, nil
+	}
+
+	return nil, fmt.Errorf("no %s state", state.MetricType)
+}
+
+// Windows of the meter rates, in the order of their stats
+var meterRateWindows = [3]time.Duration{time.Minute, 5 * time.Minute, 15 * time.Minute}
+var meterRateStats = [3]string{"rate._1min", "rate._5min", "rate._15min"}
+
+// A fresh metric plus what was saved: the count is added to its own and the saved rates
+// to its rates, decaying as their moving averages would have without new events.
+type restoredMetric struct {
+	timemetrics.Metric
+	saved_at time.Time
+	count    int64
+	rates    [3]float64
+}
+
+func (m *restoredMetric) getRate(i int, t time.Time) float64 {
+	elapsed := t.Sub(m.saved_at)
+	if elapsed < 0 {
+		elapsed = 0
+	}
+
+	return m.rates[i] * math.Exp(-float64(elapsed)/float64(meterRateWindows[i]))
+}
+
+func (m *restoredMetric) GetKeys(t time.Time, tsd_key string, dup bool) []string {
+	keys := m.Metric.GetKeys(t, tsd_key, dup)
+	base := getKeyBase(tsd_key)
+
+	for i, key := range keys {
+		//<base>.<stat> <timestamp> <value> <tags>
+		fields := strings.SplitN(key, " ", 4)
+		if len(fields) < 3 {
+			continue
+		}
+
+		switch stat := strings.TrimPrefix(fields[0], base+"."); stat {
+		case "count":
+			if count, err := strconv.ParseInt(fields[2], 10, 64); err == nil {
+				fields[2] = strconv.FormatInt(count+m.count, 10)
+			}
+		default:
+			for r, rate_stat := range meterRateStats {
+				if stat != rate_stat {
+					continue
+				}
+				if rate, err := strconv.ParseFloat(fields[2], 64); err == nil {
+					fields[2] = fmt.Sprintf("%.3f", rate+m.getRate(r, t))
+				}
+			}
+		}
+
+		keys[i] = strings.Join(fields, " ")
+	}
+
+	return keys
+}
+
+func (m *restoredMetric) GetMaxTime() time.Time {
+	if max_time := m.Metric.GetMaxTime(); max_time.After(m.saved_at) {
+		return max_time
+	}
+	return m.saved_at
+}
+
+func (m *restoredMetric) ZeroOut() {
+	m.Metric.ZeroOut()
+	m.count = 0
+	m.rates = [3]float64{}
+}
+
+func (m *restoredMetric) Count() int64 {
+	if c, ok := m.Metric.(metricCount); ok {
+		return c.Count() + m.count
+	}
+	return m.count
+}
+
+func (m *restoredMetric) getRates() [3]float64 {
+	var rates [3]float64
+	if r, ok := m.Metric.(meterRates); ok {
+		rates = [3]float64{r.Rate1(), r.Rate5(), r.Rate15()}
+	}
+	for i := range rates {
+		rates[i] += m.getRate(i, m.GetMaxTime())
+	}
+
+	return rates
+}
+
+func (m *restoredMetric) Rate1() float64  { return m.getRates()[0] }
+func (m *restoredMetric) Rate5() float64  { return m.getRates()[1] }
+func (m *restoredMetric) Rate15() float64 { return m.getRates()[2] }
+
+func (m *restoredMetric) Sample() timemetrics.Sample {
+	if h, ok := m.Metric.(histogramSample); ok {
+		return h.Sample()
+	}
+	return nil
+}
+
+type fileInfoState struct {
+	LastUpdate time.Time
+	LastPush   time.Time
+}
+
+type datapoolState struct {
+	Data          map[string]tsdPointState
+	DuplicateSent map[string]time.Time
+	LastTimeFile  map[string]fileInfoState
+	TotalStale    int
+}
+
+func getDatapoolStateFilename(state_dir string, log_group_name string, channel_number int) string {
+	return filepath.Join(state_dir, fmt.Sprintf("datapool.%s.%d.gob", log_group_name, channel_number))
+}
+
+func (dp *datapool) saveState() error {
+	state := datapoolState{Data: make(map[string]tsdPointState, len(dp.data)), DuplicateSent: dp.duplicateSent,
+		LastTimeFile: make(map[string]fileInfoState, len(dp.last_time_file)), TotalStale: dp.total_stale}
+
+	for tsd_key, point := range dp.data {
+		point_state, err := newTsdPointState(point)
+		if err != nil {
+			return fmt.Errorf("%s: %s", tsd_key, err)
+		}
+		state.Data[tsd_key] = point_state
+	}
+	for filename, fi := range dp.last_time_file {
+		state.LastTimeFile[filename] = fileInfoState{LastUpdate: fi.lastUpdate, LastPush: fi.last_push}
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&state); err != nil {
+		return err
+	}
+
+	return writeFileAtomic(dp.state_file, buf.Bytes())
+}
+
+func (dp *datapool) loadState() error {
+	f, err := os.Open(dp.state_file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	var state datapoolState
+	if err := gob.NewDecoder(f).Decode(&state); err != nil {
+		return err
+	}
+
+	data := make(map[string]*tsdPoint, len(state.Data))
+	for tsd_key, point := range state.Data {
+		metric, err := dp.restoreMetric(point)
+		if err != nil {
+			return fmt.Errorf("%s: %s", tsd_key, err)
+		}
+		data[tsd_key] = &tsdPoint{data: metric, metric_type: point.MetricType, filename: point.Filename, last_push: point.LastPush,
+			last_crunched_push: point.LastCrunchedPush, never_stale: point.NeverStale}
+	}
+	for tsd_key, point := range data {
+		dp.data[tsd_key] = point
+	}
+	for tsd_key, dup_time := range state.DuplicateSent {
+		dp.duplicateSent[tsd_key] = dup_time
+	}
+	for filename, fi := range state.LastTimeFile {
+		dp.last_time_file[filename] = fileInfo{lastUpdate: fi.LastUpdate, last_push: fi.LastPush}
+	}
+	dp.total_stale = state.TotalStale
+	dp.total_keys = len(dp.data)
+
+	return nil
+}
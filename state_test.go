@@ -0,0 +1,130 @@
+package logmetrics
+
+import (
+	"math"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newTestDatapool(state_file string) *datapool {
+	lg := &logGroup{name: "test", histogram_size: 256, histogram_alpha_decay: 0.15, histogram_rescale_threshold_min: 60,
+		ewma_interval: 30, stale_treshold_min: 15}
+
+	return &datapool{lg: lg, data: make(map[string]*tsdPoint), duplicateSent: make(map[string]time.Time),
+		last_time_file: make(map[string]fileInfo), state_file: state_file}
+}
+
+func TestDatapoolStateRoundTrip(t *testing.T) {
+	state_file := filepath.Join(t.TempDir(), "datapool.test.0.gob")
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	dp := newTestDatapool(state_file)
+	for _, metric_type := range []string{"counter", "meter", "histogram"} {
+		dp.data[metric_type] = &tsdPoint{data: dp.newMetric(metric_type, t0), metric_type: metric_type, filename: "a.log",
+			last_push: t0, last_crunched_push: t0.Add(time.Second), never_stale: metric_type == "meter"}
+		for i, val := range []int64{3, 5, 7} {
+			dp.data[metric_type].data.Update(t0.Add(time.Duration(i)*time.Second), val)
+		}
+	}
+	dp.duplicateSent["counter"] = t0.Add(time.Minute)
+	dp.last_time_file["a.log"] = fileInfo{lastUpdate: t0.Add(2 * time.Second), last_push: t0}
+	dp.total_stale = 4
+
+	if err := dp.saveState(); err != nil {
+		t.Fatalf("saveState: %s", err)
+	}
+
+	restored := newTestDatapool(state_file)
+	if err := restored.loadState(); err != nil {
+		t.Fatalf("loadState: %s", err)
+	}
+
+	if len(restored.data) != 3 || restored.total_keys != 3 {
+		t.Fatalf("expected 3 metrics, got %d", len(restored.data))
+	}
+	for _, metric_type := range []string{"counter", "meter"} {
+		if count := restored.data[metric_type].data.(metricCount).Count(); count != 15 {
+			t.Errorf("%s count is %d, expected 15", metric_type, count)
+		}
+	}
+	values := restored.data["histogram"].data.(histogramSample).Sample().(sampleValues).Values()
+	if !reflect.DeepEqual(values, []int64{3, 5, 7}) {
+		t.Errorf("histogram sample is %v, expected [3 5 7]", values)
+	}
+	if count := restored.data["histogram"].data.(metricCount).Count(); count != 3 {
+		t.Errorf("histogram count is %d, expected 3", count)
+	}
+
+	for metric_type, point := range dp.data {
+		got := restored.data[metric_type]
+		if got.metric_type != point.metric_type || got.filename != point.filename || !got.last_push.Equal(point.last_push) ||
+			!got.last_crunched_push.Equal(point.last_crunched_push) || got.never_stale != point.never_stale {
+			t.Errorf("%s restored as %+v, expected %+v", metric_type, got, point)
+		}
+	}
+	if !restored.duplicateSent["counter"].Equal(dp.duplicateSent["counter"]) {
+		t.Errorf("duplicateSent restored as %v", restored.duplicateSent)
+	}
+	if fi := restored.last_time_file["a.log"]; !fi.lastUpdate.Equal(t0.Add(2*time.Second)) || !fi.last_push.Equal(t0) {
+		t.Errorf("last_time_file restored as %+v", fi)
+	}
+	if restored.total_stale != 4 {
+		t.Errorf("total_stale restored as %d", restored.total_stale)
+	}
+}
+
+func TestDatapoolStateMissingFile(t *testing.T) {
+	dp := newTestDatapool(filepath.Join(t.TempDir(), "none.gob"))
+	if err := dp.loadState(); err != nil || len(dp.data) != 0 {
+		t.Fatalf("expected a fresh start, got %d metrics and %v", len(dp.data), err)
+	}
+}
+
+func TestRestoredMeterKeepsRates(t *testing.T) {
+	state_file := filepath.Join(t.TempDir(), "datapool.test.0.gob")
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	tsd_key := "app.hits.%s %d %s host=a"
+
+	dp := newTestDatapool(state_file)
+	meter := dp.newMetric("meter", t0)
+	for i := 0; i < 120; i++ {
+		meter.Update(t0.Add(time.Duration(i)*time.Second), 3)
+	}
+	saved_at := meter.GetMaxTime()
+	dp.data["meter"] = &tsdPoint{data: meter, metric_type: "meter"}
+
+	if err := dp.saveState(); err != nil {
+		t.Fatalf("saveState: %s", err)
+	}
+	restored := newTestDatapool(state_file)
+	if err := restored.loadState(); err != nil {
+		t.Fatalf("loadState: %s", err)
+	}
+	data := restored.data["meter"].data
+
+	saved, got := meter.(meterRates), data.(meterRates)
+	if saved.Rate1() == 0 || got.Rate1() != saved.Rate1() || got.Rate5() != saved.Rate5() || got.Rate15() != saved.Rate15() {
+		t.Errorf("restored rates are %f %f %f, expected %f %f %f", got.Rate1(), got.Rate5(), got.Rate15(),
+			saved.Rate1(), saved.Rate5(), saved.Rate15())
+	}
+	if !reflect.DeepEqual(data.GetKeys(saved_at, tsd_key, false), meter.GetKeys(saved_at, tsd_key, false)) {
+		t.Errorf("restored keys are %v, expected %v", data.GetKeys(saved_at, tsd_key, false), meter.GetKeys(saved_at, tsd_key, false))
+	}
+
+	//Without events the saved rates decay as the moving averages would
+	restored_meter := data.(*restoredMetric)
+	if rate := restored_meter.getRate(0, saved_at.Add(time.Minute)); math.Abs(rate-saved.Rate1()/math.E) > 1e-9 {
+		t.Errorf("1 min rate a minute later is %f, expected %f", rate, saved.Rate1()/math.E)
+	}
+
+	//New events add up to the saved count, nothing was marked at once
+	data.Update(saved_at.Add(time.Second), 1)
+	if count := data.(metricCount).Count(); count != 361 {
+		t.Errorf("count is %d, expected 361", count)
+	}
+	if marked := restored_meter.Metric.(metricCount).Count(); marked != 1 {
+		t.Errorf("expected only the new event to be marked on the meter, got %d", marked)
+	}
+}
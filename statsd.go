@@ -0,0 +1,134 @@
+package logmetrics
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Forwards data points as raw StatsD events, skipping the timemetrics aggregation.
+// Owned by a single datapool.
+type statsdClient struct {
+	cfg         *Config
+	do_not_send bool
+
+	conn    net.Conn
+	backoff backoff
+}
+
+func (sc *statsdClient) getTarget() string {
+	return fmt.Sprintf("%s:%d", sc.cfg.statsdHost, sc.cfg.statsdPort)
+}
+
+func (sc *statsdClient) getBackoffs() []*backoff {
+	return []*backoff{&sc.backoff}
+}
+
+func getStatsdType(metric_type string) string {
+	switch metric_type {
+	case "histogram":
+		return "ms"
+	default:
+		return "c"
+	}
+}
+
+func cleanStatsdName(value string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ':', '|', '@', '#', ',', ' ', '\t':
+			return '_'
+		}
+		return r
+	}, value)
+}
+
+// Plain StatsD has no tags, their values are appended to the name instead
+func (sc *statsdClient) formatDataPoint(data_point dataPoint) string {
+	name := cleanStatsdName(data_point.base)
+	statsd_type := getStatsdType(data_point.metric_type)
+
+	all_tags := data_point.tags
+	if data_point.tag != "" {
+		all_tags = append(all_tags[:len(all_tags):len(all_tags)], data_point.tag)
+	}
+
+	if sc.cfg.statsdDogTags {
+		dog_tags := make([]string, 0, len(all_tags))
+		for _, tag := range all_tags {
+			if kv := strings.SplitN(tag, "=", 2); len(kv) == 2 {
+				dog_tags = append(dog_tags, cleanStatsdName(kv[0])+":"+cleanStatsdName(kv[1]))
+			}
+		}
+
+		if len(dog_tags) == 0 {
+			return fmt.Sprintf("%s:%d|%s", name, data_point.value, statsd_type)
+		}
+		return fmt.Sprintf("%s:%d|%s|#%s", name, data_point.value, statsd_type, strings.Join(dog_tags, ","))
+	}
+
+	for _, tag := range all_tags {
+		if kv := strings.SplitN(tag, "=", 2); len(kv) == 2 && kv[1] != "" {
+			name += "." + strings.Replace(cleanStatsdName(kv[1]), ".", "_", -1)
+		}
+	}
+
+	return fmt.Sprintf("%s:%d|%s", name, data_point.value, statsd_type)
+}
+
+func (sc *statsdClient) send(data []byte) {
+	if sc.do_not_send {
+		fmt.Print(string(data))
+		return
+	}
+
+	var err error
+	for {
+		if sc.backoff.failFast(bytes.Count(data, []byte("\n"))) {
+			return
+		}
+
+		//Reconnect if needed
+		if sc.conn == nil {
+			if sc.conn, err = net.Dial("udp", sc.getTarget()); err != nil {
+				sc.backoff.failed(sc.cfg, fmt.Sprintf("Unable to connect to StatsD at %s: %s", sc.getTarget(), err))
+				continue
+			}
+		}
+
+		if _, err = sc.conn.Write(data); err != nil {
+			sc.conn.Close()
+			sc.conn = nil
+			sc.backoff.failed(sc.cfg, fmt.Sprintf("Error writting data to StatsD: %s", err))
+		} else {
+			sc.backoff.succeeded()
+			return
+		}
+	}
+}
+
+func (sc *statsdClient) sendDataPoints(data_points []dataPoint) {
+	var buf bytes.Buffer
+	for _, data_point := range data_points {
+		line := sc.formatDataPoint(data_point)
+
+		//Pack as many events as possible per datagram
+		if buf.Len() > 0 && buf.Len()+len(line)+1 > maxDatagramPayload {
+			sc.send(buf.Bytes())
+			buf.Reset()
+		}
+		buf.WriteString(line + "\n")
+	}
+
+	if buf.Len() > 0 {
+		sc.send(buf.Bytes())
+	}
+}
+
+func (sc *statsdClient) close() {
+	if sc.conn != nil {
+		sc.conn.Close()
+		sc.conn = nil
+	}
+}
@@ -0,0 +1,35 @@
+package logmetrics
+
+import (
+	"testing"
+)
+
+func TestStatsdFormatDataPoint(t *testing.T) {
+	tests := []struct {
+		name       string
+		dog_tags   bool
+		data_point dataPoint
+		expected   string
+	}{
+		{"meter", false, dataPoint{base: "app.hits", metric_type: "meter", value: 3}, "app.hits:3|c"},
+		{"counter", false, dataPoint{base: "app.bytes", metric_type: "counter", value: 512}, "app.bytes:512|c"},
+		{"histogram", false, dataPoint{base: "app.latency", metric_type: "histogram", value: 42}, "app.latency:42|ms"},
+		{"tag values appended", false,
+			dataPoint{base: "app.hits", metric_type: "meter", value: 1, tags: []string{"host=web1.prod", "dc="}, tag: "status=200"},
+			"app.hits.web1_prod.200:1|c"},
+		{"reserved characters cleaned", false,
+			dataPoint{base: "app.hits:total", metric_type: "meter", value: 1, tags: []string{"path=/a|b@c"}},
+			"app.hits_total./a_b_c:1|c"},
+		{"dogstatsd tags", true,
+			dataPoint{base: "app.latency", metric_type: "histogram", value: 42, tags: []string{"host=web1.prod", "path=/a,b"}, tag: "status=200"},
+			"app.latency:42|ms|#host:web1.prod,path:/a_b,status:200"},
+		{"dogstatsd without tags", true, dataPoint{base: "app.hits", metric_type: "counter", value: 1}, "app.hits:1|c"},
+	}
+
+	for _, test := range tests {
+		sc := &statsdClient{cfg: &Config{statsdDogTags: test.dog_tags}}
+		if line := sc.formatDataPoint(test.data_point); line != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.name, test.expected, line)
+		}
+	}
+}
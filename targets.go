@@ -0,0 +1,175 @@
+package logmetrics
+
+import (
+	"fmt"
+	"hash/crc32"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Points per target on the hash ring, spreads metrics more evenly
+const hashRingReplicas = 100
+
+func rotateTargets(targets []string, n int) []string {
+	rotated := make([]string, len(targets))
+	for i := range targets {
+		rotated[i] = targets[(i+n)%len(targets)]
+	}
+
+	return rotated
+}
+
+// Target selection of request based outputs, same as connSink's: a target is used until
+// a request to it fails and the backoff only kicks in once all of them failed.
+// The first target is tried again after push_failback_interval on another one.
+type requestTargets struct {
+	cfg      *Config
+	output   *outputConfig
+	current  int
+	moved_at time.Time
+	backoff  backoff
+}
+
+func (t *requestTargets) get() string {
+	targets := t.output.getTargets()
+	if t.current != 0 && time.Now().Sub(t.moved_at) > time.Duration(t.cfg.pushFailbackInterval)*time.Second {
+		log.Printf("Failing back to %s", targets[0])
+		t.current = 0
+	}
+
+	return targets[t.current]
+}
+
+func (t *requestTargets) failed(msg string) {
+	t.current = (t.current + 1) % len(t.output.getTargets())
+	t.moved_at = time.Now()
+	if t.current == 0 {
+		t.backoff.failed(t.cfg, msg)
+	} else if t.backoff.isClosed() {
+		log.Print(msg)
+	}
+}
+
+func (t *requestTargets) succeeded() {
+	t.backoff.succeeded()
+}
+
+type hashRingPoint struct {
+	hash uint32
+	sink int
+}
+
+// Sends each series to the same target every time using consistent hashing on key_prefix.key_suffix
+// and its tags, so all the stats of a series end up together. There's one sink per target, each
+// failing over to the targets after it when its own is down.
+type hashSink struct {
+	sinks []sink
+	ring  []hashRingPoint
+	bases *metricPrefixes
+}
+
+func newHashSink(config *Config, output *outputConfig, do_not_send bool) *hashSink {
+	s := hashSink{bases: config.keyBases}
+
+	targets := output.getTargets()
+	for i, target := range targets {
+		o := *output
+		o.pushHosts = rotateTargets(targets, i)
+		s.sinks = append(s.sinks, newOutputSink(config, &o, do_not_send))
+
+		for r := 0; r < hashRingReplicas; r++ {
+			s.ring = append(s.ring, hashRingPoint{hash: crc32.ChecksumIEEE([]byte(fmt.Sprintf("%s-%d", target, r))), sink: i})
+		}
+	}
+	sort.Slice(s.ring, func(i, j int) bool { return s.ring[i].hash < s.ring[j].hash })
+
+	return &s
+}
+
+func (s *hashSink) String() string {
+	targets := make([]string, len(s.sinks))
+	for i, sub := range s.sinks {
+		targets[i] = sub.String()
+	}
+
+	return "hash by metric of " + strings.Join(targets, " | ")
+}
+
+// Metric without its stat and sorted tags. Internal stats and the like keep their whole name.
+func (s *hashSink) getSeries(line string) string {
+	l, err := parseTsdLine(line)
+	if err != nil {
+		return line
+	}
+
+	if s.bases != nil {
+		if base, _, found := s.bases.split(l.metric); found {
+			l.metric = base
+		}
+	}
+
+	return getSeriesKey(l)
+}
+
+func (s *hashSink) getSink(series string) int {
+	h := crc32.ChecksumIEEE([]byte(series))
+	i := sort.Search(len(s.ring), func(i int) bool { return s.ring[i].hash >= h })
+	if i == len(s.ring) {
+		i = 0
+	}
+
+	return s.ring[i].sink
+}
+
+func (s *hashSink) write(lines []string) int {
+	groups := make([][]string, len(s.sinks))
+	for _, line := range lines {
+		i := s.getSink(s.getSeries(line))
+		groups[i] = append(groups[i], line)
+	}
+
+	byte_written := 0
+	for i, group := range groups {
+		if len(group) > 0 {
+			byte_written += s.sinks[i].write(group)
+		}
+	}
+
+	return byte_written
+}
+
+func (s *hashSink) getPutErrors() int64 {
+	var put_errors int64
+	for _, sub := range s.sinks {
+		if r, ok := sub.(putErrorCounter); ok {
+			put_errors += r.getPutErrors()
+		}
+	}
+
+	return put_errors
+}
+
+func (s *hashSink) getBackoffs() []*backoff {
+	backoffs := make([]*backoff, 0, len(s.sinks))
+	for _, sub := range s.sinks {
+		if r, ok := sub.(backoffReporter); ok {
+			backoffs = append(backoffs, r.getBackoffs()...)
+		}
+	}
+
+	return backoffs
+}
+
+func (s *hashSink) flush() {
+	for _, sub := range s.sinks {
+		sub.flush()
+	}
+}
+
+func (s *hashSink) close() {
+	for _, sub := range s.sinks {
+		sub.close()
+	}
+}
@@ -0,0 +1,63 @@
+package logmetrics
+
+import (
+	"testing"
+)
+
+// Keeps what it's given
+type recordingSink struct {
+	lines []string
+}
+
+func (s *recordingSink) write(lines []string) int {
+	s.lines = append(s.lines, lines...)
+	return len(lines)
+}
+
+func (s *recordingSink) flush()         {}
+func (s *recordingSink) close()         {}
+func (s *recordingSink) String() string { return "recording" }
+
+func TestHashSinkKeepsSeriesTogether(t *testing.T) {
+	config := newTestConfig()
+	config.keyBases = newMetricPrefixes([]string{"app.latency"})
+	output := &outputConfig{pushType: "tsd", pushProto: "tcp", pushStrategy: "hash",
+		pushHosts: []string{"tsd1:4242", "tsd2:4242", "tsd3:4242", "tsd4:4242"}}
+
+	s := newHashSink(config, output, true)
+	recorders := make([]*recordingSink, len(s.sinks))
+	for i := range s.sinks {
+		recorders[i] = &recordingSink{}
+		s.sinks[i] = recorders[i]
+	}
+
+	var lines []string
+	for _, call := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		for _, stat := range []string{"count", "p50", "p99", "rate._1min"} {
+			//Tag order doesn't matter either
+			lines = append(lines, "app.latency."+stat+" 10 1 call="+call+" host=x", "app.latency."+stat+" 10 1 host=x call="+call)
+		}
+	}
+	s.write(lines)
+
+	used := 0
+	seen := make(map[string]int)
+	for i, r := range recorders {
+		if len(r.lines) > 0 {
+			used++
+		}
+		for _, line := range r.lines {
+			series := s.getSeries(line)
+			if previous, found := seen[series]; found && previous != i {
+				t.Errorf("series %q sent to targets %d and %d", series, previous, i)
+			}
+			seen[series] = i
+		}
+	}
+	if len(seen) != 8 {
+		t.Errorf("expected 8 series, got %d: %v", len(seen), seen)
+	}
+	if used < 2 {
+		t.Errorf("expected series to be spread over the targets, only %d used", used)
+	}
+}
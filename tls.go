@@ -0,0 +1,44 @@
+package logmetrics
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+)
+
+// Builds the client TLS config of a push_tls block:
+//
+//	push_tls: { ca_file: ..., cert_file: ..., key_file: ..., server_name: ..., insecure_skip_verify: false }
+//
+// Without ca_file the system roots are used.
+func parseTlsConfig(name string, conf *tlsFileConfig) *tls.Config {
+	ca_file, cert_file, key_file := conf.CaFile, conf.CertFile, conf.KeyFile
+	tls_config := tls.Config{ServerName: conf.ServerName, InsecureSkipVerify: conf.InsecureSkipVerify}
+
+	if ca_file != "" {
+		pem, err := ioutil.ReadFile(ca_file)
+		if err != nil {
+			configFail("", name+".ca_file", "%s", err)
+		}
+
+		tls_config.RootCAs = x509.NewCertPool()
+		if !tls_config.RootCAs.AppendCertsFromPEM(pem) {
+			configFail("", name+".ca_file", "no certificate found in %s", ca_file)
+		}
+	}
+
+	//Client certificate auth
+	if cert_file != "" || key_file != "" {
+		if cert_file == "" || key_file == "" {
+			configFail("", name, "needs both cert_file and key_file")
+		}
+
+		cert, err := tls.LoadX509KeyPair(cert_file, key_file)
+		if err != nil {
+			configFail("", name, "unable to load client certificate: %s", err)
+		}
+		tls_config.Certificates = []tls.Certificate{cert}
+	}
+
+	return &tls_config
+}
@@ -0,0 +1,254 @@
+package logmetrics
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+
+	cert_file string
+	key_file  string
+}
+
+// Signed by parent, self-signed when parent is nil
+func newTestCert(t *testing.T, dir string, name string, parent *testCert, template *x509.Certificate) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template.SerialNumber = serial
+	template.Subject = pkix.Name{CommonName: name}
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+
+	signer, signer_key := template, key
+	if parent != nil {
+		signer, signer_key = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signer_key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key_der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := testCert{cert: cert, key: key, cert_file: filepath.Join(dir, name+".pem"), key_file: filepath.Join(dir, name+".key")}
+	ioutil.WriteFile(c.cert_file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	ioutil.WriteFile(c.key_file, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key_der}), 0600)
+
+	return &c
+}
+
+type testPki struct {
+	ca     *testCert
+	server *testCert
+	client *testCert
+}
+
+func newTestPki(t *testing.T) *testPki {
+	dir := t.TempDir()
+
+	ca := newTestCert(t, dir, "ca", nil, &x509.Certificate{IsCA: true, BasicConstraintsValid: true,
+		KeyUsage: x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature})
+	server := newTestCert(t, dir, "tsd.test", ca, &x509.Certificate{DNSNames: []string{"tsd.test"},
+		KeyUsage: x509.KeyUsageDigitalSignature, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}})
+	client := newTestCert(t, dir, "collector", ca, &x509.Certificate{
+		KeyUsage: x509.KeyUsageDigitalSignature, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}})
+
+	return &testPki{ca: ca, server: server, client: client}
+}
+
+// TLS listener requiring a client certificate signed by the test CA. Records the lines
+// received on each connection and drops a connection once it received drop_after lines.
+type tlsListener struct {
+	net.Listener
+
+	mu          sync.Mutex
+	connections [][]string
+	client_cns  []string
+	drop_after  int
+}
+
+func newTlsListener(t *testing.T, pki *testPki, drop_after int) *tlsListener {
+	server_cert, err := tls.LoadX509KeyPair(pki.server.cert_file, pki.server.key_file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client_cas := x509.NewCertPool()
+	client_cas.AddCert(pki.ca.cert)
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{server_cert},
+		ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: client_cas})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l := &tlsListener{Listener: ln, drop_after: drop_after}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go l.read(conn.(*tls.Conn))
+		}
+	}()
+	t.Cleanup(func() { ln.Close() })
+
+	return l
+}
+
+func (l *tlsListener) read(conn *tls.Conn) {
+	defer conn.Close()
+
+	if err := conn.Handshake(); err != nil {
+		return
+	}
+
+	l.mu.Lock()
+	n := len(l.connections)
+	l.connections = append(l.connections, nil)
+	l.client_cns = append(l.client_cns, conn.ConnectionState().PeerCertificates[0].Subject.CommonName)
+	l.mu.Unlock()
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		l.mu.Lock()
+		l.connections[n] = append(l.connections[n], scanner.Text())
+		drop := l.drop_after > 0 && len(l.connections[n]) >= l.drop_after
+		l.mu.Unlock()
+
+		if drop {
+			return
+		}
+	}
+}
+
+func (l *tlsListener) getConnections() ([][]string, []string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	connections := make([][]string, len(l.connections))
+	for i, lines := range l.connections {
+		connections[i] = append([]string(nil), lines...)
+	}
+	return connections, append([]string(nil), l.client_cns...)
+}
+
+func (l *tlsListener) newSink(t *testing.T, pki *testPki) *connSink {
+	tls_config := parseTlsConfig("push_tls", &tlsFileConfig{CaFile: pki.ca.cert_file, CertFile: pki.client.cert_file,
+		KeyFile: pki.client.key_file, ServerName: "tsd.test"})
+
+	output := &outputConfig{pushHosts: []string{l.Addr().String()}, pushProto: "tcp", pushType: "tsd", pushTls: tls_config}
+	return newBufferedConnSink(newTestConfig(), output, false, formatTsdLine)
+}
+
+func waitForConnections(t *testing.T, l *tlsListener, done func(connections [][]string) bool) ([][]string, []string) {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		connections, client_cns := l.getConnections()
+		if done(connections) {
+			return connections, client_cns
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out, listener got %v", connections)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTlsSinkClientCertificate(t *testing.T) {
+	pki := newTestPki(t)
+	l := newTlsListener(t, pki, 0)
+
+	s := l.newSink(t, pki)
+	defer s.close()
+	s.write([]string{"a 1 1 host=x"})
+	s.flush()
+
+	connections, client_cns := waitForConnections(t, l, func(connections [][]string) bool {
+		return len(connections) == 1 && len(connections[0]) == 1
+	})
+	if connections[0][0] != "put a 1 1 host=x" {
+		t.Errorf("received %q", connections[0][0])
+	}
+	if client_cns[0] != "collector" {
+		t.Errorf("expected the client certificate to be used, server saw %q", client_cns[0])
+	}
+}
+
+func TestTlsSinkRejectedWithoutClientCertificate(t *testing.T) {
+	pki := newTestPki(t)
+	l := newTlsListener(t, pki, 0)
+
+	tls_config := parseTlsConfig("push_tls", &tlsFileConfig{CaFile: pki.ca.cert_file, ServerName: "tsd.test"})
+	conn, err := tls.Dial("tcp", l.Addr().String(), tls_config)
+	if err != nil {
+		//Refused during the handshake
+		return
+	}
+	defer conn.Close()
+
+	//With TLS 1.3 the server only reports the missing certificate after the handshake
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("put a 1 1 host=x\n"))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("expected the server to refuse a client without certificate")
+	}
+}
+
+func TestTlsSinkReconnects(t *testing.T) {
+	pki := newTestPki(t)
+	l := newTlsListener(t, pki, 1)
+
+	s := l.newSink(t, pki)
+	defer s.close()
+
+	//The listener drops the connection after a line, writes fail once the client notices
+	i := 0
+	connections, client_cns := waitForConnections(t, l, func(connections [][]string) bool {
+		if len(connections) >= 2 && len(connections[1]) > 0 {
+			return true
+		}
+		i++
+		s.write([]string{"a 1 " + strconv.Itoa(i) + " host=x"})
+		s.flush()
+		return false
+	})
+
+	if connections[0][0] != "put a 1 1 host=x" {
+		t.Errorf("first connection received %q", connections[0][0])
+	}
+	for n, client_cn := range client_cns {
+		if client_cn != "collector" {
+			t.Errorf("connection %d used client certificate %q", n, client_cn)
+		}
+	}
+}
@@ -2,10 +2,9 @@ package logmetrics
 
 import (
 	"bytes"
+	"fmt"
 	"log"
-	"os"
 
-	"github.com/mathpl/golang-pkg-pcre/src/pkg/pcre"
 	"github.com/metakeule/replacer"
 )
 
@@ -19,27 +18,25 @@ type transform struct {
 type replace struct {
 	str      string
 	repl     []byte
-	matcher  *pcre.Regexp
+	matcher  regexMatcher
 	replacer replacer.Replacer
 }
 
 type match_or_default struct {
 	str         string
 	default_val string
-	matcher     *pcre.Regexp
+	matcher     regexMatcher
 }
 
-func (r *replace) init(regexp string, template string) {
-	matcher := pcre.MustCompile(regexp, 0)
-	r.matcher = &matcher
+func (r *replace) init(matcher regexMatcher, template string) {
+	r.matcher = matcher
 
 	r.replacer = replacer.New()
 	r.replacer.Parse([]byte(template))
 }
 
-func (m *match_or_default) init(regexp string, default_val string) {
-	matcher := pcre.MustCompile(regexp, 0)
-	m.matcher = &matcher
+func (m *match_or_default) init(matcher regexMatcher, default_val string) {
+	m.matcher = matcher
 	m.default_val = default_val
 }
 
@@ -49,19 +46,18 @@ func (t *transform) apply(data string) string {
 		switch op := operation.(type) {
 		case replace:
 			if (t.replace_only_one && !got_match) || !t.replace_only_one {
-				m := op.matcher.MatcherString(data, 0)
-				got_match = m.Matches()
+				matches := op.matcher.findSubmatch(data)
+				got_match = matches != nil
 				if got_match {
 					var buf bytes.Buffer
 
-					replace_map := build_replace_map(m.ExtractString())
+					replace_map := build_replace_map(matches)
 					op.replacer.Replace(&buf, replace_map)
 					data = buf.String()
 				}
 			}
 		case match_or_default:
-			m := op.matcher.Matcher([]byte(data), 0)
-			if !m.Matches() {
+			if !op.matcher.match(data) {
 				if t.log_default_assign {
 					log.Printf("Assigning default value to: %s", data)
 				}
@@ -73,51 +69,74 @@ func (t *transform) apply(data string) string {
 	return data
 }
 
-func parseTransform(conf map[interface{}]interface{}) map[int]transform {
-	transforms := make(map[int]transform)
+// Each mapping gets the transforms resolved against its own groups. Transforms by name
+// only apply to the regexes that have that group, at least one of them must.
+func parseTransform(lg *logGroup, conf map[interface{}]*transformConfig) {
+	group := lg.name
+	transforms := make(map[interface{}]transform)
 
-	for position, setting := range conf {
-		switch s := setting.(type) {
-		case map[interface{}]interface{}:
-			var transform transform
+	for key, setting := range conf {
+		path := fmt.Sprintf("transform.%v", key)
+		if setting == nil {
+			configFail(group, path, "empty transform")
+		}
+
+		transform := transform{replace_only_one: setting.ReplaceOnlyOne, log_default_assign: setting.LogDefaultAssign}
+
+		if len(setting.Operations) == 0 {
+			configFail(group, path+".operations", "missing, no operation under transform")
+		}
 
-			var ok bool
-			if transform.replace_only_one, ok = s["replace_only_one"].(bool); !ok {
-				transform.replace_only_one = false
+		for i, str_args := range setting.Operations {
+			op_path := fmt.Sprintf("%s.operations[%d]", path, i)
+
+			if len(str_args) != 3 {
+				configFail(group, op_path, "expected [operation, regex, value], got %d items", len(str_args))
+			}
+
+			matcher, err := compileRegex(lg.regex_engine, str_args[1])
+			if err != nil {
+				configFail(group, op_path+"[1]", "invalid regex: %s", err)
 			}
-			if transform.log_default_assign, ok = s["log_default_assign"].(bool); !ok {
-				transform.log_default_assign = false
+
+			switch str_args[0] {
+			case "replace":
+				var r replace
+				r.init(matcher, str_args[2])
+				transform.ops = append(transform.ops, r)
+			case "match_or_default":
+				var m match_or_default
+				m.init(matcher, str_args[2])
+				transform.ops = append(transform.ops, m)
+			default:
+				configFail(group, op_path+"[0]", "unknown operation %s, expected replace or match_or_default", str_args[0])
 			}
+		}
+
+		transforms[key] = transform
+	}
+
+	mappings := lg.usedMappings()
+	for _, m := range mappings {
+		m.transform = make(map[int]transform)
+	}
 
-			var operations []interface{}
-			if operations, ok = s["operations"].([]interface{}); ok {
-				for _, args := range operations {
-
-					var str_args []string
-					// Convert to []string
-					for _, arg := range args.([]interface{}) {
-						str_args = append(str_args, arg.(string))
-					}
-
-					switch str_args[0] {
-					case "replace":
-						var r replace
-						r.init(str_args[1], str_args[2])
-						transform.ops = append(transform.ops, r)
-					case "match_or_default":
-						var m match_or_default
-						m.init(str_args[1], str_args[2])
-						transform.ops = append(transform.ops, m)
-					}
+	for key, transform := range transforms {
+		path := fmt.Sprintf("transform.%v", key)
+		found := false
+		for _, m := range mappings {
+			if name, ok := key.(string); ok && m.fields == nil {
+				if _, ok := m.group_positions[name]; !ok {
+					continue
 				}
-			} else {
-				log.Print("No operation under tranform group.")
-				os.Exit(1)
 			}
 
-			transforms[position.(int)] = transform
+			m.transform[m.position(group, path, key)] = transform
+			found = true
 		}
-	}
 
-	return transforms
+		if !found {
+			configFail(group, path, "no capture group named %v", key)
+		}
+	}
 }
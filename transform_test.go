@@ -0,0 +1,59 @@
+package logmetrics
+
+import (
+	"testing"
+)
+
+func TestTransformFollowsEachRegexGroups(t *testing.T) {
+	//call is group 1 of the first regex and group 2 of the second one
+	conf := &logGroupConfig{Format: "regex", RegexEngine: "re2", Goroutines: 1, KeyPrefix: "app",
+		Re: []regexConfig{
+			{Re: `(?P<call>\w+)\stook\s(?P<ms>\d+)ms`},
+			{Re: `(?P<ms>\d+)ms\sspent\sin\s(?P<call>\w+)`, Tags: map[string]interface{}{"call": "call"}},
+		},
+		Tags: map[string]interface{}{"call": "call"},
+		Transform: map[interface{}]*transformConfig{
+			"call": {Operations: [][]string{{"match_or_default", "^get", "other"}}},
+		},
+	}
+	lg := newLogGroup("app", conf)
+	dp := &datapool{lg: lg}
+
+	for i, test := range []struct {
+		line     string
+		expected []string
+	}{
+		{"getUser took 5ms", []string{"getUser took 5ms", "getUser", "5"}},
+		{"postUser took 5ms", []string{"postUser took 5ms", "other", "5"}},
+		{"5ms spent in getUser", []string{"5ms spent in getUser", "5", "getUser"}},
+		{"5ms spent in postUser", []string{"5ms spent in postUser", "5", "other"}},
+	} {
+		re_index := i / 2
+		matches := lg.re[re_index].findSubmatch(test.line)
+		transformed := dp.applyTransforms(lg.mappings[re_index], matches)
+
+		if len(transformed) != len(test.expected) {
+			t.Fatalf("%q: expected %v, got %v", test.line, test.expected, transformed)
+		}
+		for pos := range test.expected {
+			if transformed[pos] != test.expected[pos] {
+				t.Errorf("%q: expected %v, got %v", test.line, test.expected, transformed)
+				break
+			}
+		}
+	}
+}
+
+func TestTransformUnknownGroup(t *testing.T) {
+	conf := &logGroupConfig{Format: "regex", RegexEngine: "re2", Goroutines: 1,
+		Re: []regexConfig{{Re: `(?P<call>\w+)\stook\s(?P<ms>\d+)ms`}},
+		Transform: map[interface{}]*transformConfig{
+			"method": {Operations: [][]string{{"match_or_default", "^get", "other"}}},
+		},
+	}
+
+	err := parseWith(func() { newLogGroup("app", conf) })
+	if e, ok := err.(*ConfigError); !ok || e.Path != "transform.method" {
+		t.Errorf("expected an error on transform.method, got %v", err)
+	}
+}
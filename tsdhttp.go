@@ -0,0 +1,186 @@
+package logmetrics
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type tsdHttpPoint struct {
+	Metric    string            `json:"metric"`
+	Timestamp int64             `json:"timestamp"`
+	Value     json.Number       `json:"value"`
+	Tags      map[string]string `json:"tags"`
+}
+
+type tsdHttpError struct {
+	Datapoint tsdHttpPoint `json:"datapoint"`
+	Error     string       `json:"error"`
+}
+
+type tsdHttpResponse struct {
+	Success int            `json:"success"`
+	Failed  int            `json:"failed"`
+	Errors  []tsdHttpError `json:"errors"`
+}
+
+func newTsdHttpPoint(l tsdLine) tsdHttpPoint {
+	point := tsdHttpPoint{Metric: l.metric, Timestamp: l.timestamp, Value: json.Number(l.value),
+		Tags: make(map[string]string, len(l.tags))}
+	for _, t := range l.tags {
+		point.Tags[t.key] = t.value
+	}
+
+	return point
+}
+
+type tsdHttpSink struct {
+	cfg         *Config
+	output      *outputConfig
+	targets     requestTargets
+	client      *http.Client
+	do_not_send bool
+}
+
+func newTsdHttpSink(config *Config, output *outputConfig, do_not_send bool) *tsdHttpSink {
+	return &tsdHttpSink{cfg: config, output: output, targets: requestTargets{cfg: config, output: output},
+		client: &http.Client{Timeout: time.Duration(config.pushTimeout) * time.Second}, do_not_send: do_not_send}
+}
+
+func (c *tsdHttpSink) getBackoffs() []*backoff {
+	return []*backoff{&c.targets.backoff}
+}
+
+func (c *tsdHttpSink) String() string {
+	return strings.Join(c.output.getTargets(), ", ") + " over http in tsd_http format"
+}
+
+var errTsdHttpRejected = errors.New("request rejected by TSD")
+
+// Returns the points TSD reported as failed. A non-nil error means the whole batch
+// should be considered as not sent.
+func (c *tsdHttpSink) post(url string, points []tsdHttpPoint) ([]tsdHttpPoint, error) {
+	body, err := json.Marshal(points)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusNoContent {
+		return nil, nil
+	}
+
+	if resp.StatusCode >= 500 {
+		return nil, fmt.Errorf("TSD returned %s: %s", resp.Status, respBody)
+	}
+
+	var putResp tsdHttpResponse
+	if err := json.Unmarshal(respBody, &putResp); err != nil {
+		if resp.StatusCode >= 400 {
+			log.Printf("TSD returned %s: %s", resp.Status, respBody)
+			return nil, errTsdHttpRejected
+		}
+		//Nothing to report on a 2xx without details
+		return nil, nil
+	}
+
+	if putResp.Failed == 0 {
+		return nil, nil
+	}
+
+	//Summary only, no way to tell which ones failed: resend them all
+	if len(putResp.Errors) == 0 {
+		return points, nil
+	}
+
+	failed := make([]tsdHttpPoint, len(putResp.Errors))
+	for i, e := range putResp.Errors {
+		failed[i] = e.Datapoint
+	}
+	log.Printf("TSD rejected %d of %d points, first error: %s", putResp.Failed, len(points), putResp.Errors[0].Error)
+
+	return failed, nil
+}
+
+// Blocks until every point has been accepted or has failed more than push_retries times.
+func (c *tsdHttpSink) put(points []tsdHttpPoint) {
+	retries := 0
+	for len(points) > 0 {
+		if c.targets.backoff.failFast(len(points)) {
+			return
+		}
+		url := fmt.Sprintf("http://%s/api/put?details", c.targets.get())
+		failed, err := c.post(url, points)
+		if err == errTsdHttpRejected {
+			log.Printf("Dropping %d points rejected by TSD", len(points))
+			return
+		} else if err != nil {
+			c.targets.failed(fmt.Sprintf("Error posting data to %s: %s", url, err))
+			continue
+		}
+		c.targets.succeeded()
+
+		if len(failed) > 0 {
+			retries++
+			if retries > c.cfg.pushRetries {
+				log.Printf("Dropping %d points still failing after %d retries", len(failed), c.cfg.pushRetries)
+				return
+			}
+		}
+
+		points = failed
+	}
+}
+
+func (c *tsdHttpSink) write(lines []string) int {
+	byte_written := 0
+	points := make([]tsdHttpPoint, 0, len(lines))
+	for _, line := range lines {
+		l, err := parseTsdLine(line)
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		points = append(points, newTsdHttpPoint(l))
+		byte_written += len(line)
+	}
+
+	if c.do_not_send {
+		for _, point := range points {
+			fmt.Printf("%+v\n", point)
+		}
+		return byte_written
+	}
+
+	for start := 0; start < len(points); start += c.cfg.pushBatchSize {
+		end := start + c.cfg.pushBatchSize
+		if end > len(points) {
+			end = len(points)
+		}
+		c.put(points[start:end])
+	}
+
+	return byte_written
+}
+
+func (c *tsdHttpSink) flush() {
+}
+
+func (c *tsdHttpSink) close() {
+}
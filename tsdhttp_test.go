@@ -0,0 +1,168 @@
+package logmetrics
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// Records every /api/put request and answers with what respond returns for it
+type tsdHttpServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	requests [][]tsdHttpPoint
+}
+
+func newTsdHttpServer(t *testing.T, respond func(points []tsdHttpPoint) (int, interface{})) *tsdHttpServer {
+	s := &tsdHttpServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/put" {
+			t.Errorf("unexpected request to %s", r.URL.Path)
+		}
+
+		var points []tsdHttpPoint
+		if err := json.NewDecoder(r.Body).Decode(&points); err != nil {
+			t.Errorf("invalid body: %s", err)
+		}
+
+		s.mu.Lock()
+		s.requests = append(s.requests, points)
+		s.mu.Unlock()
+
+		status, body := respond(points)
+		w.WriteHeader(status)
+		if body != nil {
+			json.NewEncoder(w).Encode(body)
+		}
+	}))
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+func (s *tsdHttpServer) newSink(t *testing.T) *tsdHttpSink {
+	host, port, err := net.SplitHostPort(s.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	port_number, _ := strconv.Atoi(port)
+
+	return newTestTsdHttpSink(&outputConfig{pushHost: host, pushPort: port_number, pushType: "tsd_http"})
+}
+
+func newTestTsdHttpSink(output *outputConfig) *tsdHttpSink {
+	config := &Config{pushBatchSize: 2, pushRetries: 2, pushTimeout: 5, pushWait: 1, pushMaxWait: 1, pushBackoffFactor: 2,
+		pushBreakerThreshold: 5, pushFailbackInterval: 60}
+	return newTsdHttpSink(config, output, false)
+}
+
+func metricNames(points []tsdHttpPoint) []string {
+	names := make([]string, len(points))
+	for i, point := range points {
+		names[i] = point.Metric
+	}
+	return names
+}
+
+var tsdHttpTestLines = []string{
+	"a 1 1 host=x",
+	"b 1 2 host=x",
+	"c 1 3 host=x",
+	"d 1 4 host=x",
+	"e 1 5 host=x",
+}
+
+func TestTsdHttpBatches(t *testing.T) {
+	s := newTsdHttpServer(t, func(points []tsdHttpPoint) (int, interface{}) {
+		return http.StatusNoContent, nil
+	})
+
+	s.newSink(t).write(tsdHttpTestLines)
+
+	if len(s.requests) != 3 {
+		t.Fatalf("expected 3 requests of at most push_batch_size points, got %d", len(s.requests))
+	}
+	for i, expected := range [][]string{{"a", "b"}, {"c", "d"}, {"e"}} {
+		if names := metricNames(s.requests[i]); len(names) != len(expected) || names[0] != expected[0] {
+			t.Errorf("request %d sent %v, expected %v", i, names, expected)
+		}
+	}
+	if point := s.requests[0][0]; point.Timestamp != 1 || point.Value != "1" || point.Tags["host"] != "x" {
+		t.Errorf("unexpected point %+v", point)
+	}
+}
+
+func TestTsdHttpResendsFailedDetails(t *testing.T) {
+	//b is always rejected, the others are accepted
+	s := newTsdHttpServer(t, func(points []tsdHttpPoint) (int, interface{}) {
+		resp := tsdHttpResponse{}
+		for _, point := range points {
+			if point.Metric == "b" {
+				resp.Failed++
+				resp.Errors = append(resp.Errors, tsdHttpError{Datapoint: point, Error: "nope"})
+			} else {
+				resp.Success++
+			}
+		}
+		return http.StatusBadRequest, resp
+	})
+
+	s.newSink(t).write(tsdHttpTestLines[:2])
+
+	//The batch, then b alone push_retries times
+	if len(s.requests) != 3 {
+		t.Fatalf("expected 3 requests, got %d", len(s.requests))
+	}
+	for _, request := range s.requests[1:] {
+		if names := metricNames(request); len(names) != 1 || names[0] != "b" {
+			t.Errorf("expected only the failed point to be resent, got %v", names)
+		}
+	}
+}
+
+func TestTsdHttpResendsFailedSummary(t *testing.T) {
+	//Summary only: the whole batch is resent until it goes through
+	s := newTsdHttpServer(t, func(points []tsdHttpPoint) (int, interface{}) {
+		return http.StatusOK, tsdHttpResponse{Success: len(points) - 1, Failed: 1}
+	})
+
+	s.newSink(t).write(tsdHttpTestLines[:2])
+
+	if len(s.requests) != 3 {
+		t.Fatalf("expected the batch to be sent once and retried push_retries times, got %d requests", len(s.requests))
+	}
+	for _, request := range s.requests {
+		if len(request) != 2 {
+			t.Errorf("expected the whole batch to be resent, got %v", metricNames(request))
+		}
+	}
+}
+
+func TestTsdHttpFailsOver(t *testing.T) {
+	down := newTsdHttpServer(t, func(points []tsdHttpPoint) (int, interface{}) {
+		return http.StatusServiceUnavailable, nil
+	})
+	up := newTsdHttpServer(t, func(points []tsdHttpPoint) (int, interface{}) {
+		return http.StatusNoContent, nil
+	})
+
+	c := newTestTsdHttpSink(&outputConfig{pushType: "tsd_http",
+		pushHosts: []string{down.Listener.Addr().String(), up.Listener.Addr().String()}})
+	c.write(tsdHttpTestLines)
+
+	//Stays on the second target once the first one failed, without waiting
+	if len(down.requests) != 1 {
+		t.Errorf("expected a single request to the failed target, got %d", len(down.requests))
+	}
+	if len(up.requests) != 3 {
+		t.Errorf("expected every batch to go to the second target, got %d requests", len(up.requests))
+	}
+	if !c.targets.backoff.isClosed() {
+		t.Error("expected no backoff while a target is up")
+	}
+}
@@ -3,32 +3,43 @@ package logmetrics
 import (
 	"fmt"
 	"log"
-	"net"
 	"time"
 )
 
 type pusher struct {
 	cfg            *Config
 	tsd_push       chan []string
-	do_not_send    bool
+	spool          *spool
+	sinks          []sink
 	channel_number int
 	hostname       string
 	key_push_stats keyPushStats
 
-	Bye chan bool
+	Bye  chan bool
+	done chan bool
+}
+
+// Returns once everything queued is sent and the outputs are closed
+func (p *pusher) Stop() {
+	p.Bye <- true
+	<-p.done
 }
 
 type keyPushStats struct {
 	key_pushed    int64
 	byte_pushed   int64
+	put_errors    int64
+	breaker_state int
+	blocked       time.Duration
+	key_dropped   int64
 	last_report   time.Time
 	hostname      string
 	interval      int
 	pusher_number int
 }
 
-func (f *keyPushStats) inc(data_written int) {
-	f.key_pushed++
+func (f *keyPushStats) inc(nb_keys int, data_written int) {
+	f.key_pushed += int64(nb_keys)
 	f.byte_pushed += int64(data_written)
 }
 
@@ -37,9 +48,13 @@ func (f *keyPushStats) getLine() []string {
 
 	f.last_report = t
 
-	line := make([]string, 2)
+	line := make([]string, 6)
 	line[0] = fmt.Sprintf("logmetrics_collector.pusher.key_sent %d %d host=%s pusher_number=%d", t.Unix(), f.key_pushed, f.hostname, f.pusher_number)
 	line[1] = fmt.Sprintf("logmetrics_collector.pusher.byte_sent %d %d host=%s pusher_number=%d", t.Unix(), f.byte_pushed, f.hostname, f.pusher_number)
+	line[2] = fmt.Sprintf("logmetrics_collector.pusher.put_errors %d %d host=%s pusher_number=%d", t.Unix(), f.put_errors, f.hostname, f.pusher_number)
+	line[3] = fmt.Sprintf("logmetrics_collector.pusher.breaker_state %d %d host=%s pusher_number=%d", t.Unix(), f.breaker_state, f.hostname, f.pusher_number)
+	line[4] = fmt.Sprintf("logmetrics_collector.pusher.blocked_ms %d %d host=%s pusher_number=%d", t.Unix(), f.blocked/time.Millisecond, f.hostname, f.pusher_number)
+	line[5] = fmt.Sprintf("logmetrics_collector.pusher.key_dropped %d %d host=%s pusher_number=%d", t.Unix(), f.key_dropped, f.hostname, f.pusher_number)
 
 	return line
 }
@@ -48,76 +63,104 @@ func (f *keyPushStats) isTimeForStats() bool {
 	return time.Now().Sub(f.last_report) > time.Duration(f.interval)*time.Second
 }
 
-func writeLine(config *Config, do_not_send bool, conn net.Conn, line string) (int, net.Conn) {
-	if config.pushType == "tsd" {
-		line = ("put " + line + "\n")
-	} else {
-		line = line
+// Grabs whatever else is already waiting in the channel, up to push_batch_size lines
+func (p *pusher) fillBatch(keys []string) []string {
+	batch := keys
+	for len(batch) < p.cfg.pushBatchSize {
+		select {
+		case keys := <-p.tsd_push:
+			batch = append(batch, keys...)
+		default:
+			return batch
+		}
 	}
 
-	byte_line := []byte(line)
-	byte_written := len(byte_line)
-
-	var err error
-	if do_not_send {
-		fmt.Print(line + "\n")
-	} else {
-		for {
-			//Reconnect if needed
-			if conn == nil {
-				target := config.GetTsdTarget()
-				log.Printf("Reconnecting to %s", target)
-
-				if conn, err = net.Dial(config.pushProto, target); err != nil {
-					log.Printf("Unable to reconnect: %s", err)
-					time.Sleep(time.Duration(config.pushWait) * time.Second)
-				}
-			}
+	return batch
+}
 
-			if conn != nil {
-				_, err = conn.Write(byte_line)
+// Every sink gets every line, in order
+func (p *pusher) writeBatch(lines []string) {
+	byte_written := 0
+	for _, s := range p.sinks {
+		byte_written += s.write(lines)
+	}
+
+	p.key_push_stats.inc(len(lines), byte_written)
+}
 
-				if err != nil {
-					log.Printf("Error writting data: %s", err)
-					conn.Close()
-					conn = nil
-					time.Sleep(time.Duration(config.pushWait) * time.Second)
-				} else {
-					break
+// Worst breaker state, total time spent waiting and keys dropped by open breakers of all outputs
+func (p *pusher) getBackoffStats() (int, time.Duration, int64) {
+	breaker_state := breakerClosed
+	var blocked time.Duration
+	var dropped int64
+	for _, s := range p.sinks {
+		if r, ok := s.(backoffReporter); ok {
+			for _, b := range r.getBackoffs() {
+				if b.state > breaker_state {
+					breaker_state = b.state
 				}
+				blocked += b.blocked
+				dropped += b.dropped
 			}
+		}
+	}
+
+	return breaker_state, blocked, dropped
+}
 
+// Errors sent back by the outputs, only tsd ones report them for now
+func (p *pusher) getPutErrors() int64 {
+	var put_errors int64
+	for _, s := range p.sinks {
+		if r, ok := s.(putErrorCounter); ok {
+			put_errors += r.getPutErrors()
 		}
 	}
 
-	return byte_written, conn
+	return put_errors
 }
 
 func (p *pusher) start() {
-	log.Printf("TsdPusher[%d] started. Pushing keys to %s:%d over %s in %s format", p.channel_number, p.cfg.pushHost,
-		p.cfg.pushPort, p.cfg.pushProto, p.cfg.pushType)
+	for _, s := range p.sinks {
+		log.Printf("TsdPusher[%d] started. Pushing keys to %s", p.channel_number, s)
+	}
+	if len(p.sinks) == 0 {
+		log.Printf("TsdPusher[%d] started without outputs, discarding keys", p.channel_number)
+	}
 
 	p.key_push_stats = keyPushStats{last_report: time.Now(), hostname: p.hostname, interval: p.cfg.stats_interval, pusher_number: p.channel_number}
 
-	var conn net.Conn
+	defer close(p.done)
+
+	//Buffered outputs are flushed at least this often
+	flushTicker := time.NewTicker(time.Duration(p.cfg.pushFlushInterval) * time.Millisecond)
+	defer flushTicker.Stop()
+
 	for {
 		select {
 		case keys := <-p.tsd_push:
-			for _, line := range keys {
-				var bytes_written int
-				bytes_written, conn = writeLine(p.cfg, p.do_not_send, conn, line)
-
-				p.key_push_stats.inc(bytes_written)
-
-				//Stats on key pushed, limit checks with modulo (now() is a syscall)
-				if (p.key_push_stats.key_pushed%100) == 0 && p.key_push_stats.isTimeForStats() {
-					for _, local_line := range p.key_push_stats.getLine() {
-						bytes_written, conn = writeLine(p.cfg, p.do_not_send, conn, local_line)
-						p.key_push_stats.inc(bytes_written)
-					}
-				}
+			p.writeBatch(p.fillBatch(keys))
+
+			if p.key_push_stats.isTimeForStats() {
+				p.key_push_stats.put_errors = p.getPutErrors()
+				p.key_push_stats.breaker_state, p.key_push_stats.blocked, p.key_push_stats.key_dropped = p.getBackoffStats()
+				p.writeBatch(p.key_push_stats.getLine())
+			}
+		case <-flushTicker.C:
+			for _, s := range p.sinks {
+				s.flush()
 			}
 		case <-p.Bye:
+			//Nothing else comes in once the spool is stopped
+			if p.spool != nil {
+				p.spool.Bye <- true
+			}
+			for len(p.tsd_push) > 0 {
+				p.writeBatch(p.fillBatch(<-p.tsd_push))
+			}
+			for _, s := range p.sinks {
+				s.close()
+			}
 			log.Printf("TsdPusher[%d] stopped.", p.channel_number)
 			return
 		}
@@ -125,19 +168,32 @@ func (p *pusher) start() {
 }
 
 func StartTsdPushers(config *Config, tsd_pushers []chan []string, do_not_send bool) []*pusher {
-	if config.pushPort == 0 {
-		return nil
-	}
-
+	//Still started without outputs to drain the channels, datapools and tailers
+	//would block once they're full
 	hostname := getHostname()
 
 	allPushers := make([]*pusher, 0)
 	for i, _ := range tsd_pushers {
 		channel_number := i
 
+		//Each pusher gets its own connections
+		sinks := make([]sink, len(config.outputs))
+		for j := range config.outputs {
+			sinks[j] = newSink(config, &config.outputs[j], channel_number, do_not_send)
+		}
+
 		tsd_push := tsd_pushers[channel_number]
+
+		//Optional disk backlog between the datapools and the pusher
+		var sp *spool
+		if config.spoolDir != "" {
+			sp = newSpool(config, channel_number, tsd_push)
+			go sp.start()
+			tsd_push = sp.out
+		}
+
 		bye := make(chan bool)
-		p := pusher{cfg: config, tsd_push: tsd_push, hostname: hostname, do_not_send: do_not_send, channel_number: channel_number, Bye: bye}
+		p := pusher{cfg: config, tsd_push: tsd_push, spool: sp, sinks: sinks, hostname: hostname, channel_number: channel_number, Bye: bye, done: make(chan bool)}
 		go p.start()
 		allPushers = append(allPushers, &p)
 	}
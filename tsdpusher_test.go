@@ -0,0 +1,37 @@
+package logmetrics
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPushersWithoutOutputsDrain(t *testing.T) {
+	config := newTestConfig()
+	config.pushFlushInterval = 1000
+	config.stats_interval = 60
+
+	tsd_pushers := []chan []string{make(chan []string, 1)}
+	ps := StartTsdPushers(config, tsd_pushers, false)
+	if len(ps) != 1 {
+		t.Fatalf("expected a pusher even without outputs, got %d", len(ps))
+	}
+
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 10; i++ {
+			tsd_pushers[0] <- []string{"app.hits.count 1 1 host=a"}
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected keys to be discarded, the channel stayed full")
+	}
+
+	ps[0].Stop()
+	if ps[0].key_push_stats.key_pushed != 10 {
+		t.Errorf("expected the 10 keys discarded to be counted, got %d", ps[0].key_push_stats.key_pushed)
+	}
+}